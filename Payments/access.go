@@ -0,0 +1,25 @@
+package main
+
+import (
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+// invokePolicy - the roles allowed to call each invoke function. Payments are recorded by the 'Agreement' chaincode in the
+// name of the agreement party, or arbiter, whose transaction made them, and are only accepted through that chaincode.
+var invokePolicy = common.Policy{
+	"init": {common.RoleAdmin},
+	"createPayment": {common.RoleAdmin, common.RoleCustomer, common.RoleServiceProvider, common.RoleArbiter},
+	"resetState": {common.RoleAdmin},
+	"migrateKeys": {common.RoleAdmin},
+	"rebuildIndexes": {common.RoleAdmin},
+}
+
+// queryPolicy - the roles allowed to call each query function
+var queryPolicy = common.Policy{
+	"getAll_Payment": {common.RoleAdmin, common.RoleCustomer, common.RoleServiceProvider},
+	"getPaymentById": {common.RoleAdmin, common.RoleCustomer, common.RoleServiceProvider},
+	"getPaymentsByAgreement": {common.RoleAdmin, common.RoleCustomer, common.RoleServiceProvider},
+	"getPaymentHistory": {common.RoleAdmin, common.RoleAuditor, common.RoleCustomer, common.RoleServiceProvider},
+	"listPayments": {common.RoleAdmin, common.RoleCustomer, common.RoleServiceProvider},
+	"getAllowedCallers": {common.RoleAdmin, common.RoleTreasury},
+}
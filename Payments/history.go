@@ -0,0 +1,45 @@
+package main
+
+import (
+"fmt"
+"encoding/json"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+// ============================================================================================================================
+// getPaymentHistory - fetch every version of a Payment with the transaction, time and identity that stored it and the
+// fields it changed. Auditors can read the history of any Payment, everyone else only of Payments from or to their account.
+// ============================================================================================================================
+func (t *ManagePayment) getPaymentHistory(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return common.RaiseError(stub, common.CodeValidation, "Incorrect number of arguments. Expecting \"Payment Id\" as an argument.")
+	}
+	paymentId := args[0]
+	paymentAsBytes, err := getPaymentState(stub, paymentId)
+	if err != nil {
+		return common.RaiseError(stub, common.CodeInternal, "Failed to get state for " + paymentId)
+	}
+	payment := common.Payment{}
+	err = common.DecodeState(paymentAsBytes, "Payment " + paymentId, &payment)
+	if err != nil {
+		return nil, err
+	}
+	if len(paymentAsBytes) == 0 || payment.PaymentId != paymentId {
+		return common.RaiseError(stub, common.CodeNotFound, paymentId + " not Found.")
+	}
+	caller, err := common.GetIdentity(stub)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	if !caller.HasRole(common.RoleAdmin, common.RoleAuditor) && payment.CustomerAccount != caller.OwnerId && payment.ReceiverAccount != caller.OwnerId {
+		return common.RejectUnauthorized(stub, caller.OwnerId + " is not the payer or receiver of Payment " + paymentId + ".")
+	}
+	history, err := common.GetHistory(stub, PaymentObjectType, paymentId)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Fetched the history of Payment " + paymentId)
+	return json.Marshal(map[string]interface{}{"paymentId": paymentId, "history": history})
+}
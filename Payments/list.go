@@ -0,0 +1,69 @@
+package main
+
+import (
+"encoding/json"
+"fmt"
+"strconv"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+// ============================================================================================================================
+// listPayments - query a page of the Payments the caller may see, filtered and sorted as asked in the optional JSON
+// argument (see common.ListRequest). The status filter and sort use the PaymentType, the date ones the LastUpdateDate
+// the Payment was made on and the amount ones the AmountPaid. Every stored Payment is read and decoded on each call and the
+// matches are sorted and paged in memory, because the range queries of this Fabric version can neither sort on a field
+// nor count the matches they skip; the cost of a page grows with the number of Payments stored, whatever the pageSize.
+// ============================================================================================================================
+func (t *ManagePayment) listPayments(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) > 1 {
+		return common.RaiseError(stub, common.CodeValidation, "Incorrect number of arguments. Expecting the list request in JSON, or nothing.")
+	}
+	requestJson := ""
+	if len(args) == 1 {
+		requestJson = args[0]
+	}
+	request, err := common.ParseListRequest(requestJson)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	// admins see every Payment, everyone else only the Payments made from or to their account
+	caller, err := common.GetIdentity(stub)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	items := []common.ListItem{}
+	err = common.ScanPartialCompositeKey(stub, PaymentObjectType, []string{}, func(key string, attributes []string, valueAsBytes []byte) error {
+		payment := common.Payment{}
+		err := json.Unmarshal(valueAsBytes, &payment)
+		if err != nil {
+			return err
+		}
+		if !caller.HasRole(common.RoleAdmin) && payment.CustomerAccount != caller.OwnerId && payment.ReceiverAccount != caller.OwnerId {
+			return nil
+		}
+		item := common.ListItem{
+			Id: payment.PaymentId,
+			Status: payment.PaymentType,
+			CustomerId: payment.CustomerAccount,
+			ServiceProviderId: payment.ReceiverAccount,
+			Date: payment.LastUpdateDate,
+			Amount: payment.AmountPaid,
+			Record: valueAsBytes,
+		}
+		if request.Matches(item) {
+			items = append(items, item)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	page, err := request.Page(items)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	fmt.Println("Listed " + strconv.Itoa(page.Count) + " of " + strconv.Itoa(page.Total) + " Payments")
+	return json.Marshal(page)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+"errors"
+"fmt"
+"strconv"
+"encoding/json"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+// ============================================================================================================================
+// resetState - admin function for test networks to delete every Payment. The caller must pass common.ResetConfirmation
+// to show it means it.
+// ============================================================================================================================
+func (t *ManagePayment) resetState(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 || args[0] != common.ResetConfirmation {
+		return common.RaiseError(stub, common.CodeValidation, "Resetting deletes every Payment. Pass \"" + common.ResetConfirmation + "\" to confirm.")
+	}
+	deleted, err := common.ResetState(stub, map[string]bool{common.AllowedCallersKey: true})
+	if err != nil {
+		return nil, err
+	}
+	err = common.EmitEvent(stub, common.EventAdminActionPerformed, "", &common.AdminActionPerformed{
+		Chaincode: "ManagePayment",
+		Action: "resetState",
+		Details: map[string]string{"keysDeleted": strconv.Itoa(deleted)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("ManagePayment state reset, " + strconv.Itoa(deleted) + " keys deleted")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// migrateKeys - admin function moving the Payments of the earlier key layout to their composite keys, then deleting the
+// JSON array index that listed them. Every plain key is looked at, so that Payments missing from the index are moved too.
+// Running it again once everything was moved does nothing.
+// ============================================================================================================================
+func (t *ManagePayment) migrateKeys(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	keys, err := common.ListPlainKeys(stub)
+	if err != nil {
+		return nil, err
+	}
+	migrated := 0
+	for _, key := range keys {
+		if key == PaymentIndexStr {
+			err = stub.DelState(key)							//replaced by the payment~id index
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		moved, err := migratePayment(stub, key)
+		if err != nil {
+			return nil, err
+		}
+		if moved {
+			migrated++
+		}
+	}
+	err = common.EmitEvent(stub, common.EventAdminActionPerformed, "", &common.AdminActionPerformed{
+		Chaincode: "ManagePayment",
+		Action: "migrateKeys",
+		Details: map[string]string{"paymentsMigrated": strconv.Itoa(migrated)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println(strconv.Itoa(migrated) + " Payments moved to composite keys")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// migratePayment - move the Payment stored under a plain key to its composite key. Other plain keys, such as the registered
+// caller chaincodes, are settings and stay where they are. The Payment is stored again in its current format and gets a
+// first history entry.
+// ============================================================================================================================
+func migratePayment(stub shim.ChaincodeStubInterface, key string) (bool, error) {
+	paymentAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return false, errors.New("Failed to get state for " + key)
+	}
+	record := struct{
+		PaymentId string
+	}{}
+	if len(paymentAsBytes) == 0 || json.Unmarshal(paymentAsBytes, &record) != nil || record.PaymentId != key {
+		return false, nil
+	}
+	payment := common.Payment{}
+	err = json.Unmarshal(paymentAsBytes, &payment)
+	if err != nil {
+		return false, errors.New("Payment " + key + " cannot be read: " + err.Error())
+	}
+	// Payments of the earlier layout held a float amount, read as DefaultCurrency, and no currency of their own
+	if payment.Currency == "" {
+		payment.Currency = payment.AmountPaid.Currency
+	}
+	paymentAsBytes, err = json.Marshal(payment)
+	if err != nil {
+		return false, err
+	}
+	err = putPaymentState(stub, payment.AgreementId, payment.PaymentId, paymentAsBytes)
+	if err != nil {
+		return false, err
+	}
+	return true, stub.DelState(key)
+}
+
+// ============================================================================================================================
+// rebuildIndexes - admin function that drops the payment~id index and writes it again from the stored Payments, e.g. after
+// an index entry was lost
+// ============================================================================================================================
+func (t *ManagePayment) rebuildIndexes(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	_, err := common.DeleteCompositeKeys(stub, PaymentIdIndex)
+	if err != nil {
+		return nil, err
+	}
+	// (agreementId, paymentId) of every stored Payment, indexed once the scan is done so that it does not see its own writes
+	paymentKeys := [][]string{}
+	err = common.ScanPartialCompositeKey(stub, PaymentObjectType, []string{}, func(key string, attributes []string, valueAsBytes []byte) error {
+		paymentKeys = append(paymentKeys, attributes)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, attributes := range paymentKeys {
+		idKey, err := common.CreateCompositeKey(PaymentIdIndex, attributes[1])
+		if err != nil {
+			return nil, err
+		}
+		err = stub.PutState(idKey, []byte(attributes[0]))
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = common.EmitEvent(stub, common.EventAdminActionPerformed, "", &common.AdminActionPerformed{
+		Chaincode: "ManagePayment",
+		Action: "rebuildIndexes",
+		Details: map[string]string{"paymentsIndexed": strconv.Itoa(len(paymentKeys))},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Payment index rebuilt from " + strconv.Itoa(len(paymentKeys)) + " Payments")
+	return nil, nil
+}
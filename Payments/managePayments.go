@@ -1,30 +1,21 @@
 package main
 
 import (
-"errors"
 "fmt"
 "strconv"
+"strings"
 "encoding/json"
-"time"
 "github.com/hyperledger/fabric/core/chaincode/shim"
+"github.com/Dimple-Kanwar/Office-Depot/common"
 )
 
 // ManagePayment example simple Chaincode implementation
 type ManagePayment struct {
 }
 
-var PaymentIndexStr = "_PaymentIndexStr"
-
-type Payment struct{
-	PaymentId string
-	AgreementId string 
-	PaymentType string 
-	CustomerAccount string
-	ReceiverAccount string
-	AmountPaid float64
-	LastUpdatedBy string 
-	LastUpdateDate int64
-}
+var PaymentObjectType = "payment~agreement~id"		//Payments are stored under the composite key (payment~agreement~id, agreementId, paymentId)
+var PaymentIdIndex = "payment~id"						//index entry (payment~id, paymentId) holding the agreement Id of the Payment
+var PaymentIndexStr = "_PaymentIndexStr"				//key/value that stored the list of all Payments before they had composite keys
 
 // ============================================================================================================================
 // Main - start the chaincode for Payment management
@@ -38,18 +29,35 @@ func main() {
 // ============================================================================================================================
 // Init - reset all the things
 // ============================================================================================================================
-func (t *ManagePayment) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	var err error
-	
-	var empty []string
-	jsonAsBytes, _ := json.Marshal(empty)								//marshal an emtpy array of strings to clear the index
-	err = stub.PutState(PaymentIndexStr, jsonAsBytes)
+func (t *ManagePayment) Init(stub shim.ChaincodeStubInterface, function string, args []string) (result []byte, err error) {
+	// the events of a call that succeeded are set together as one event
+	recorder := common.RecordEvents(stub)
+	stub = recorder
+	defer func() {
+		if err == nil {
+			err = recorder.Publish("init")
+		}
+		if err != nil {
+			err = common.AsError(err)
+		}
+	}()
+	// only an admin may initialize the chaincode
+	_, err = common.RequireRole(stub, common.RoleAdmin)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	// the Init arguments are the names of the chaincodes allowed to record Payments, i.e. the deployed 'Agreement' chaincode.
+	// An upgrade without arguments keeps the names already registered.
+	allowedCallers, err := common.RegisterAllowedCallers(stub, args)
 	if err != nil {
 		return nil, err
 	}
 
-	tosend := "{ \"message\" : \"ManagePayment chaincode is deployed successfully.\", \"code\" : \"200\"}"
-	err = stub.SetEvent("evtsender", []byte(tosend))
+	err = common.EmitEvent(stub, common.EventAdminActionPerformed, "", &common.AdminActionPerformed{
+		Chaincode: "ManagePayment",
+		Action: "init",
+		Details: map[string]string{"allowedCallers": strings.Join(allowedCallers, ",")},
+	})
 	if err != nil {
 		return nil, err
 	} 
@@ -66,189 +74,350 @@ func (t *ManagePayment) Run(stub shim.ChaincodeStubInterface, function string, a
 // ============================================================================================================================
 // Invoke - Our entry Paymentint for Invocations
 // ============================================================================================================================
-func (t *ManagePayment) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+func (t *ManagePayment) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) (result []byte, err error) {
+	// every failure reaches the caller as a common.Error with its code, the events of a call that succeeded are set
+	// together as one event
+	recorder := common.RecordEvents(stub)
+	stub = recorder
+	defer func() {
+		if err == nil {
+			err = recorder.Publish(function)
+		}
+		if err != nil {
+			err = common.AsError(err)
+		}
+	}()
 	fmt.Println("invoke is running " + function)
 
+	// only the roles in the invoke policy may call a function, and functions missing from it cannot be called
+	_, err = invokePolicy.Authorize(stub, function)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	// Payments are only recorded through the registered agreement chaincode
+	if function == common.FunctionCreatePayment {
+		err := common.RequireCallerChaincode(stub, "Payments")
+		if err != nil {
+			return common.RejectSecurity(stub, function, err)
+		}
+	}
+
 	// Handle different functions
-	if function == "init" {													//initialize the chaincode state, used as reset
+	if function == "init" {													//initialize the chaincode state, existing data is kept
 		return t.Init(stub, "init", args)
-	}else if function == "createPayment" {											//create a new  Payment
+	}else if function == common.FunctionCreatePayment {											//create a new  Payment
 		return t.createPayment(stub, args)
+	}else if function == "resetState" {												//admin: wipe all Payments on a test network
+		return t.resetState(stub, args)
+	}else if function == "migrateKeys" {											//admin: move Payments from the array index to composite keys
+		return t.migrateKeys(stub, args)
+	}else if function == "rebuildIndexes" {										//admin: write the payment~id index again
+		return t.rebuildIndexes(stub, args)
 	}
 	fmt.Println("invoke did not find func: " + function)					//error
-	errMsg := "{ \"message\" : \"Received unknown function invocation\", \"code\" : \"503\"}"
-	err := stub.SetEvent("errEvent", []byte(errMsg))
-	if err != nil {
-		return nil, err
-	} 
-	return nil, nil	
+	return common.RaiseError(stub, common.CodeValidation, "Received unknown function invocation")
 }
 // ============================================================================================================================
 // Query - Our entry Paymentint for Queries
 // ============================================================================================================================
-func (t *ManagePayment) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+func (t *ManagePayment) Query(stub shim.ChaincodeStubInterface, function string, args []string) (result []byte, err error) {
+	defer func() {
+		if err != nil {
+			err = common.AsError(err)
+		}
+	}()
 	fmt.Println("query is running " + function)
 
+	// only the roles in the query policy may call a function, and functions missing from it cannot be called
+	_, err = queryPolicy.Authorize(stub, function)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+
 	// Handle different functions
 	if function == "getAll_Payment" {													//Read all  Payments
 		return t.getAll_Payment(stub, args)
+	}else if function == "getPaymentById" {											//Read a single Payment
+		return t.getPaymentById(stub, args)
+	}else if function == "getPaymentsByAgreement" {									//Read the Payments of an agreement
+		return t.getPaymentsByAgreement(stub, args)
+	}else if function == "getPaymentHistory" {										//Read every version of a Payment
+		return t.getPaymentHistory(stub, args)
+	}else if function == "listPayments" {												//Read a page of Payments
+		return t.listPayments(stub, args)
+	}else if function == "getAllowedCallers" {										//Read the chaincodes allowed to record Payments
+		return common.QueryAllowedCallers(stub)
 	}
 
 	fmt.Println("query did not find func: " + function)						//error
-	errMsg := "{ \"message\" : \"Received unknown function query\", \"code\" : \"503\"}"
-	err := stub.SetEvent("errEvent", []byte(errMsg))
-	if err != nil {
-		return nil, err
-	} 
-	return nil, nil
+	return common.RaiseError(stub, common.CodeValidation, "Received unknown function query")
 }
 // ============================================================================================================================
 // createPayment - create a new  Payment, store into chaincode state
 // ============================================================================================================================
 func (t *ManagePayment) createPayment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
-	if len(args) != 6 {
-		errMsg := "{ \"message\" : \"Incorrect number of arguments. Expecting 6 arguments.\", \"code\" : \"503\"}"
-		err = stub.SetEvent("errEvent", []byte(errMsg))
-		if err != nil {
-			return nil, err
-		} 
-		return nil, nil
-	}
 	fmt.Println("creating a new Payment")
-	//input sanitation
-	if len(args[0]) <= 0 {
-		return nil, errors.New("Agreement Id cannot be empty.")
-	}else if len(args[1]) <= 0 {
-		return nil, errors.New("Payment Type cannot be empty.")
-	}else if len(args[2]) <= 0 {
-		return nil, errors.New("Customer Payment cannot be empty.")
-	}else if len(args[3]) <= 0 {
-		return nil, errors.New("Receiver Payment cannot be empty.")
-	}else if len(args[4]) <= 0 {
-		return nil, errors.New("Amount Paid cannot be empty.")
-	}else if len(args[5]) <= 0 {
-		return nil, errors.New("Last Updated By cannot be empty.")
+	//input sanitation, the arguments are those of common.CreatePaymentRequest
+	request, err := common.ParseCreatePaymentRequest(args)
+	if err != nil {
+		return common.Raise(stub, err)
 	}
 
 	// setting attributes
-	paymentId := "PA"+ strconv.FormatInt(time.Now().Unix(), 10) // check https://play.golang.org/p/8Du2FrDk2eH
-	agreementId := args[0]
-	paymentType := args[1]
-	customerAccount := args[2]
-	receiverAccount := args[3]
-	amountPaid,_ := strconv.ParseFloat(args[4],64);
-	lastUpdatedBy := args[5]
-	lastUpdateDate := time.Now().Unix() // current unix timestamp
-	
-	fmt.Println(paymentId);
-	fmt.Println(agreementId);
-	fmt.Println(paymentType);
-	fmt.Println(customerAccount);
-	fmt.Println(receiverAccount);
-	fmt.Println(amountPaid);
-	fmt.Println(lastUpdatedBy);
-	fmt.Println(lastUpdateDate);
+	// the payment Id is derived from the agreement and the caller's idempotency key when given, from the transaction Id otherwise
+	idempotencyKey := request.IdempotencyKey
+	var paymentId string
+	if idempotencyKey != "" {
+		paymentId = common.IdempotentID("PA", request.AgreementId, idempotencyKey)
+	}else {
+		paymentId, err = common.NewID(stub, "PA", PaymentIdIndex)
+		if err != nil {
+			return nil, err
+		}
+	}
+	agreementId := request.AgreementId
+	paymentType := request.PaymentType
+	customerAccount := request.CustomerAccount
+	receiverAccount := request.ReceiverAccount
+	amountPaid := request.AmountPaid
+	// the Payment is recorded in the name of the transaction creator
+	lastUpdatedBy, err := common.CallerId(stub)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	payerAmount := request.PayerAmount
+	fxRate := request.FxRate
+	if payerAmount.Currency != amountPaid.Currency && fxRate == "" {
+		return common.RaiseError(stub, common.CodeValidation, "FX rate is required when the payer amount is in a different currency.")
+	}
+	relatedPaymentId := request.RelatedPaymentId
+	if paymentType == common.PaymentRefund && relatedPaymentId == "" {
+		return common.RaiseError(stub, common.CodeValidation, "A Refund must be linked to the Payment it refunds.")
+	}
+	lastUpdateDate, err := common.TxTimestamp(stub) // transaction timestamp
+	if err != nil {
+		return nil, err
+	}
 
 	// Fetching Payment details by Payment Id
-	PaymentAsBytes, err := stub.GetState(paymentId)
+	PaymentAsBytes, err := getPaymentState(stub, paymentId)
 	if err != nil {
-		return nil, errors.New("Failed to get Payment Id")
+		return common.RaiseError(stub, common.CodeInternal, "Failed to get Payment Id")
+	}
+	res := common.Payment{}
+	err = common.DecodeState(PaymentAsBytes, "Payment " + paymentId, &res)
+	if err != nil {
+		return common.Raise(stub, err)
 	}
-	res := Payment{}
-	json.Unmarshal(PaymentAsBytes, &res)
 	fmt.Print(" Payment Details: ")
 	fmt.Println(res)
+	if res.PaymentId == paymentId && idempotencyKey != "" {
+		if !samePaymentTerms(res, request) {
+			return common.RaiseError(stub, common.CodeConflict, "Idempotency key " + idempotencyKey + " was already used for Payment " + paymentId + " with different terms.")
+		}
+		fmt.Println("Payment already created for this idempotency key: " + paymentId)
+		return []byte(paymentId), nil				//a retried request resolves to the Payment created the first time
+	}
 	if res.PaymentId == paymentId{
 		fmt.Println("This  Payment already exists: " + paymentId)
-		errMsg := "{ \"message\" : \"This  Payment already exists.\", \"code\" : \"503\"}"
-		err := stub.SetEvent("errEvent", []byte(errMsg))
-		if err != nil {
-			return nil, err
-		} 
-		return nil, errors.New(errMsg)				//stop creating a new Payment if Payment exists already
+		return common.RaiseError(stub, common.CodeConflict, "This  Payment already exists.")				//stop creating a new Payment if Payment exists already
 	}
 
 	// create a pointer/json to the struct 'Payment'
-	PaymentJson := &Payment{paymentId, agreementId, paymentType, customerAccount, receiverAccount, amountPaid, lastUpdatedBy, lastUpdateDate};
+	PaymentJson := &common.Payment{
+		PaymentId: paymentId,
+		AgreementId: agreementId,
+		PaymentType: paymentType,
+		CustomerAccount: customerAccount,
+		ReceiverAccount: receiverAccount,
+		AmountPaid: amountPaid,
+		Currency: amountPaid.Currency,
+		PayerAmount: payerAmount,
+		FxRate: fxRate,
+		RelatedPaymentId: relatedPaymentId,
+		LastUpdatedBy: lastUpdatedBy,
+		LastUpdateDate: lastUpdateDate,
+	}
 	fmt.Printf("PaymentJson:  %v \n", PaymentJson)
 	// convert *Payment to []byte
 	PaymentJsonasBytes, err := json.Marshal(PaymentJson)
 	if err != nil {
 		return nil, err
 	}
-	//store  paymentId as key
-	err = stub.PutState(paymentId, PaymentJsonasBytes)								
-	if err != nil {
-		return nil, err
-	}
-
-	//get the Payment index
-	PaymentIndexStrAsBytes, err := stub.GetState(PaymentIndexStr)
-	if err != nil {
-		return nil, errors.New("Failed to get Payment index")
-	}
-	var PaymentIndex []string
-
-	json.Unmarshal(PaymentIndexStrAsBytes, &PaymentIndex)							//un stringify it aka JSON.parse()
-	fmt.Print("PaymentIndex after unmarshal..before append: ")
-	fmt.Println(PaymentIndex)
-
-	//append
-	PaymentIndex = append(PaymentIndex, paymentId)									//add PaymentId to index list
-	fmt.Println("! Payment index: ", PaymentIndex)
-	jsonAsBytes, _ := json.Marshal(PaymentIndex)
-	err = stub.PutState(PaymentIndexStr, jsonAsBytes)						//store PaymentId as an index
+	//store under the payment~agreement~id composite key, which is also how Payments are listed
+	err = putPaymentState(stub, agreementId, paymentId, PaymentJsonasBytes)
 	if err != nil {
 		return nil, err
 	}
 
-	// event message to set on successful  Payment creation
-	tosend := "{ \" Payment Id\" : \""+paymentId+"\", \"message\" : \" Payment created succcessfully\", \"code\" : \"200\"}"
-	err = stub.SetEvent("evtsender", []byte(tosend))
-	if err != nil {
-		return nil, err
-	} 	
+	// no event is set here: Payments are only created by the agreement chaincode, whose event carries the PaymentCreated
 	fmt.Println(" Payment created succcessfully.")
-	return nil, nil
+	return []byte(paymentId), nil
 }
 
 // ============================================================================================================================
 //  getAll_Payment- get details of all  Payment from chaincode state
 // ============================================================================================================================
 func (t *ManagePayment) getAll_Payment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var jsonResp, errResp string
-	var PaymentIndex []string
+	var jsonResp string
 	fmt.Println("Getting all Payments.")
 	var err error
 	
-	// Fetch all the indexed Payments
-	PaymentAsBytes, err := stub.GetState(PaymentIndexStr)
+	// admins see every Payment, everyone else only the Payments made from or to their account
+	caller, err := common.GetIdentity(stub)
 	if err != nil {
-		return nil, errors.New("Failed to get Payment index")
+		return common.RejectUnauthorized(stub, err.Error())
 	}
-	json.Unmarshal(PaymentAsBytes, &PaymentIndex)								//un stringify it aka JSON.parse()
-	fmt.Print("PaymentIndex : ")
-	fmt.Println(PaymentIndex)
+	// Fetch all the Payments by scanning their composite keys, which lists them agreement by agreement
 	jsonResp = "{"
-	for i,val := range PaymentIndex{
-		fmt.Println(strconv.Itoa(i) + " - looking at " + val + " for all Payment")
-		valueAsBytes, err := stub.GetState(val)
-		if err != nil {
-			errResp = "{\"Error\":\"Failed to get state for " + val + "\"}"
-			return nil, errors.New(errResp)
-		}
-		fmt.Println(valueAsBytes)
-		jsonResp = jsonResp + "\""+ val + "\":" + string(valueAsBytes[:])
-		if i < len(PaymentIndex)-1 {
-			jsonResp = jsonResp + ","
+	separator := ""
+	count := 0
+	err = common.ScanPartialCompositeKey(stub, PaymentObjectType, []string{}, func(key string, attributes []string, valueAsBytes []byte) error {
+		val := attributes[1]
+		fmt.Println(strconv.Itoa(count) + " - looking at " + val + " for all Payment")
+		count++
+		if !caller.HasRole(common.RoleAdmin) {
+			payment := common.Payment{}
+			err := common.DecodeState(valueAsBytes, "Payment " + val, &payment)
+			if err != nil {
+				return err
+			}
+			if payment.CustomerAccount != caller.OwnerId && payment.ReceiverAccount != caller.OwnerId {
+				return nil
+			}
 		}
+		jsonResp = jsonResp + separator + "\""+ val + "\":" + string(valueAsBytes[:])
+		separator = ","
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	fmt.Println("len(PaymentIndex) : ")
-	fmt.Println(len(PaymentIndex))
+	fmt.Println("Payments scanned : ")
+	fmt.Println(count)
 	jsonResp = jsonResp + "}"
 	fmt.Println("jsonResp : " + jsonResp)
 	fmt.Println("Fetched all Payments succcessfully")
 	//send it onward
 	return []byte(jsonResp), nil
 }
+
+// ============================================================================================================================
+// getPaymentById - fetch a single Payment made from or to the caller's account
+// ============================================================================================================================
+func (t *ManagePayment) getPaymentById(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return common.RaiseError(stub, common.CodeValidation, "Incorrect number of arguments. Expecting \"Payment Id\" as an argument.")
+	}
+	paymentId := args[0]
+	paymentAsBytes, err := getPaymentState(stub, paymentId)
+	if err != nil {
+		return common.RaiseError(stub, common.CodeInternal, "Failed to get state for " + paymentId)
+	}
+	payment := common.Payment{}
+	err = common.DecodeState(paymentAsBytes, "Payment " + paymentId, &payment)
+	if err != nil {
+		return nil, err
+	}
+	if len(paymentAsBytes) == 0 || payment.PaymentId != paymentId {
+		return common.RaiseError(stub, common.CodeNotFound, paymentId + " not Found.")
+	}
+	caller, err := common.GetIdentity(stub)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	if !caller.HasRole(common.RoleAdmin) && payment.CustomerAccount != caller.OwnerId && payment.ReceiverAccount != caller.OwnerId {
+		return common.RejectUnauthorized(stub, caller.OwnerId + " is not the payer or receiver of Payment " + paymentId + ".")
+	}
+	fmt.Println("Fetched Payment " + paymentId)
+	return paymentAsBytes, nil
+}
+
+// ============================================================================================================================
+// getPaymentsByAgreement - fetch every Payment of an agreement, by scanning the payment~agreement~id keys of the agreement
+// ============================================================================================================================
+func (t *ManagePayment) getPaymentsByAgreement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return common.RaiseError(stub, common.CodeValidation, "Incorrect number of arguments. Expecting \"Agreement Id\" as an argument.")
+	}
+	agreementId := args[0]
+	caller, err := common.GetIdentity(stub)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	payments := []json.RawMessage{}
+	err = common.ScanPartialCompositeKey(stub, PaymentObjectType, []string{agreementId}, func(key string, attributes []string, valueAsBytes []byte) error {
+		if !caller.HasRole(common.RoleAdmin) {
+			payment := common.Payment{}
+			err := common.DecodeState(valueAsBytes, "Payment " + attributes[1], &payment)
+			if err != nil {
+				return err
+			}
+			if payment.CustomerAccount != caller.OwnerId && payment.ReceiverAccount != caller.OwnerId {
+				return nil
+			}
+		}
+		payments = append(payments, valueAsBytes)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Fetched " + strconv.Itoa(len(payments)) + " Payments of " + agreementId)
+	return json.Marshal(payments)
+}
+
+// ============================================================================================================================
+// samePaymentTerms - whether a stored Payment records the transfer of a request, i.e. a retry of that request rather than
+// another Payment reusing its idempotency key
+// ============================================================================================================================
+func samePaymentTerms(stored common.Payment, request common.CreatePaymentRequest) bool {
+	return stored.AgreementId == request.AgreementId && stored.PaymentType == request.PaymentType &&
+		stored.CustomerAccount == request.CustomerAccount && stored.ReceiverAccount == request.ReceiverAccount &&
+		stored.AmountPaid == request.AmountPaid && stored.PayerAmount == request.PayerAmount &&
+		stored.FxRate == request.FxRate && stored.RelatedPaymentId == request.RelatedPaymentId
+}
+
+// ============================================================================================================================
+// getPaymentState - fetch a stored Payment by its Id, looking up its agreement in the payment~id index. Empty when there is none.
+// ============================================================================================================================
+func getPaymentState(stub shim.ChaincodeStubInterface, paymentId string) ([]byte, error) {
+	idKey, err := common.CreateCompositeKey(PaymentIdIndex, paymentId)
+	if err != nil {
+		return nil, err
+	}
+	agreementId, err := stub.GetState(idKey)
+	if err != nil || len(agreementId) == 0 {
+		return nil, err
+	}
+	key, err := common.CreateCompositeKey(PaymentObjectType, string(agreementId), paymentId)
+	if err != nil {
+		return nil, err
+	}
+	return stub.GetState(key)
+}
+
+// ============================================================================================================================
+// putPaymentState - store a Payment under its payment~agreement~id composite key, along with its payment~id index entry,
+// and keep it in its history
+// ============================================================================================================================
+func putPaymentState(stub shim.ChaincodeStubInterface, agreementId string, paymentId string, paymentAsBytes []byte) error {
+	key, err := common.CreateCompositeKey(PaymentObjectType, agreementId, paymentId)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(key, paymentAsBytes)
+	if err != nil {
+		return err
+	}
+	idKey, err := common.CreateCompositeKey(PaymentIdIndex, paymentId)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(idKey, []byte(agreementId))
+	if err != nil {
+		return err
+	}
+	return common.RecordHistory(stub, PaymentObjectType, paymentId, paymentAsBytes)
+}
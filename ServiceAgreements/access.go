@@ -0,0 +1,36 @@
+package main
+
+import (
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+// invokePolicy - the roles allowed to call each invoke function. Which party of the agreement the caller is, and so what it
+// may do to the agreement, is checked by the function itself.
+var invokePolicy = common.Policy{
+	"init": {common.RoleAdmin},
+	"createServiceAgreement": {common.RoleAdmin, common.RoleServiceProvider},
+	"updateServiceAgreement": {common.RoleCustomer, common.RoleServiceProvider},
+	"checkPenalty": {common.RoleAdmin, common.RoleCustomer, common.RoleServiceProvider},
+	"rejectServiceAgreement": {common.RoleCustomer},
+	"cancelServiceAgreement": {common.RoleCustomer, common.RoleServiceProvider},
+	"completeMilestone": {common.RoleServiceProvider},
+	"acceptMilestone": {common.RoleCustomer},
+	"raiseDispute": {common.RoleCustomer, common.RoleServiceProvider},
+	"resolveDispute": {common.RoleArbiter},
+	"rotateCounterparties": {common.RoleAdmin},
+	"resetState": {common.RoleAdmin},
+	"migrateKeys": {common.RoleAdmin},
+	"rebuildIndexes": {common.RoleAdmin},
+}
+
+// queryPolicy - the roles allowed to call each query function
+var queryPolicy = common.Policy{
+	"getAll_ServiceAgreement": {common.RoleAdmin, common.RoleCustomer, common.RoleServiceProvider, common.RoleArbiter},
+	"getServiceAgreementById": {common.RoleAdmin, common.RoleCustomer, common.RoleServiceProvider, common.RoleArbiter},
+	"getAgreementsByParty": {common.RoleAdmin, common.RoleCustomer, common.RoleServiceProvider},
+	"getServiceAgreementHistory": {common.RoleAdmin, common.RoleAuditor, common.RoleCustomer, common.RoleServiceProvider, common.RoleArbiter},
+	"listServiceAgreements": {common.RoleAdmin, common.RoleCustomer, common.RoleServiceProvider, common.RoleArbiter},
+	"getAllowedTransitions": {common.RoleAdmin, common.RoleCustomer, common.RoleServiceProvider, common.RoleArbiter},
+	"getDisputes": {common.RoleAdmin, common.RoleCustomer, common.RoleServiceProvider, common.RoleArbiter},
+	"getCounterpartyChaincodes": {common.RoleAdmin},
+}
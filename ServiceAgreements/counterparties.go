@@ -0,0 +1,95 @@
+package main
+
+import (
+"errors"
+"fmt"
+"encoding/json"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+var CounterpartiesStr = "_CounterpartyChaincodes"	//name for the key/value that stores the trusted Payment and Account chaincodes
+
+// Counterparties are the chaincodes ManageAgreement moves funds and records Payments through
+type Counterparties struct{
+	PaymentChaincode string `json:"paymentChaincode"`
+	AccountChaincode string `json:"accountChaincode"`
+	TxId string `json:"txId"` // transaction that last set them
+}
+
+// ============================================================================================================================
+// setCounterparties - validate and store the trusted Payment and Account chaincode names
+// ============================================================================================================================
+func setCounterparties(stub shim.ChaincodeStubInterface, paymentChaincode string, accountChaincode string) error {
+	if paymentChaincode == "" || accountChaincode == "" {
+		return common.NewError(common.CodeValidation, "Payment chaincode and Account chaincode cannot be empty.")
+	}
+	counterparties := Counterparties{paymentChaincode, accountChaincode, stub.GetTxID()}
+	counterpartiesAsBytes, err := json.Marshal(counterparties)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(CounterpartiesStr, counterpartiesAsBytes)
+}
+
+// ============================================================================================================================
+// getCounterparties - the trusted Payment and Account chaincode names, which must have been set at Init
+// ============================================================================================================================
+func getCounterparties(stub shim.ChaincodeStubInterface) (Counterparties, error) {
+	counterparties := Counterparties{}
+	counterpartiesAsBytes, err := stub.GetState(CounterpartiesStr)
+	if err != nil {
+		return counterparties, errors.New("Failed to get the Payment and Account chaincodes")
+	}
+	err = common.DecodeState(counterpartiesAsBytes, "The registered Payment and Account chaincodes", &counterparties)
+	if err != nil {
+		return counterparties, err
+	}
+	if counterparties.PaymentChaincode == "" || counterparties.AccountChaincode == "" {
+		return counterparties, common.NewError(common.CodeConflict, "The Payment and Account chaincodes are not registered, Init the chaincode with them.")
+	}
+	return counterparties, nil
+}
+
+// counterpartiesRequest is the JSON argument of rotateCounterparties
+type counterpartiesRequest struct{
+	PaymentChaincode string `json:"paymentChaincode"`
+	AccountChaincode string `json:"accountChaincode"`
+}
+
+// ============================================================================================================================
+// rotateCounterparties - admin function to point ManageAgreement at new Payment and Account chaincodes, e.g. after upgrading them
+// ============================================================================================================================
+func (t *ManageAgreement) rotateCounterparties(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	request := counterpartiesRequest{}
+	err := common.DecodePayload(args, "counterparty chaincodes", &request)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	err = setCounterparties(stub, request.PaymentChaincode, request.AccountChaincode)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	err = common.EmitEvent(stub, common.EventAdminActionPerformed, "", &common.AdminActionPerformed{
+		Chaincode: "ManageAgreement",
+		Action: "rotateCounterparties",
+		Details: map[string]string{"paymentChaincode": request.PaymentChaincode, "accountChaincode": request.AccountChaincode},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Counterparty chaincodes set to " + request.PaymentChaincode + " and " + request.AccountChaincode)
+	return nil, nil
+}
+
+// ============================================================================================================================
+// getCounterpartyChaincodes - query the trusted Payment and Account chaincode names
+// ============================================================================================================================
+func (t *ManageAgreement) getCounterpartyChaincodes(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	counterparties, err := getCounterparties(stub)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	return json.Marshal(counterparties)
+}
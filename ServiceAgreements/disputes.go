@@ -0,0 +1,321 @@
+package main
+
+import (
+"fmt"
+"encoding/hex"
+"encoding/json"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+// disputeRequest is the JSON argument of raiseDispute
+type disputeRequest struct{
+	AgreementId string `json:"agreementId"`
+	Reason string `json:"reason"`
+	EvidenceHashes []string `json:"evidenceHashes"` // hex SHA-256 digests of the evidence documents, optional
+}
+
+// resolutionRequest is the JSON argument of resolveDispute
+type resolutionRequest struct{
+	AgreementId string `json:"agreementId"`
+	Outcome string `json:"outcome"` // Full Pay, Partial Pay, Refund or Penalty
+	Amount string `json:"amount"` // decimal amount in the agreement currency, for Partial Pay and Penalty only
+	Notes string `json:"notes"`
+}
+
+// ============================================================================================================================
+// raiseDispute - either party of an agreement opens a dispute with a reason and the hashes of its evidence
+// ============================================================================================================================
+func (t *ManageAgreement) raiseDispute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	request := disputeRequest{}
+	err := common.DecodePayload(args, "dispute", &request)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	agreementId := request.AgreementId
+	if agreementId == "" {
+		return common.Raise(stub, common.MissingField("agreementId"))
+	}
+	reason := request.Reason
+	if reason == "" {
+		return common.RaiseError(stub, common.CodeValidation, "A dispute needs a reason.")
+	}
+	raisedBy, err := common.CallerId(stub)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	evidenceHashes, err := checkEvidenceHashes(request.EvidenceHashes)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	res, err := loadAgreement(stub, agreementId)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	if res.ArbiterId == "" {
+		return common.RaiseError(stub, common.CodeValidation, "Agreement " + agreementId + " has no arbiter to resolve a dispute.")
+	}
+	transition, err := findTransition(res.Status, common.StatusDisputed)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	if !transition.performableBy(partyOf(res, raisedBy)) {
+		return common.RejectUnauthorized(stub, raisedBy + " is not allowed to dispute agreement " + agreementId + ".")
+	}
+	currentTime, err := common.TxTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	dispute := common.Dispute{
+		DisputeId: "DS" + stub.GetTxID(),
+		RaisedBy: raisedBy,
+		Reason: reason,
+		EvidenceHashes: evidenceHashes,
+		RaisedDate: currentTime,
+		StatusBeforeDispute: res.Status,
+		Status: common.DisputeOpen,
+		OutcomeAmount: common.Money{Currency: res.DueAmount.Currency},
+	}
+	res.Disputes = append(res.Disputes, dispute)
+	previousStatus := res.Status
+	res.Status = common.StatusDisputed
+	res.LastUpdatedBy = raisedBy
+	res.LastUpdateDate = currentTime
+	err = saveAgreement(stub, res)
+	if err != nil {
+		return nil, err
+	}
+	err = common.EmitEvent(stub, common.EventAgreementStatusChanged, agreementId, &common.AgreementStatusChanged{
+		AgreementId: agreementId,
+		From: previousStatus,
+		To: common.StatusDisputed,
+		UpdatedBy: raisedBy,
+		DisputeId: dispute.DisputeId,
+		Reason: reason,
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Dispute " + dispute.DisputeId + " raised on " + agreementId)
+	return []byte(dispute.DisputeId), nil
+}
+
+// ============================================================================================================================
+// resolveDispute - the arbiter of the agreement closes its open dispute with an outcome, and the transfers it decides are
+// made through the 'Account' chaincode and recorded through the 'Payment' chaincode
+// ============================================================================================================================
+func (t *ManageAgreement) resolveDispute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	request := resolutionRequest{}
+	err := common.DecodePayload(args, "resolution", &request)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	agreementId := request.AgreementId
+	if agreementId == "" {
+		return common.Raise(stub, common.MissingField("agreementId"))
+	}
+	outcome := request.Outcome
+	if outcome == "" {
+		return common.Raise(stub, common.MissingField("outcome"))
+	}
+	amountArg := request.Amount
+	notes := request.Notes
+	counterparties, err := getCounterparties(stub)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	paymentChaincode := counterparties.PaymentChaincode
+	accountChaincode := counterparties.AccountChaincode
+	arbiterId, err := common.CallerId(stub)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	res, err := loadAgreement(stub, agreementId)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	if res.Status != common.StatusDisputed || len(res.Disputes) == 0 {
+		return common.RaiseError(stub, common.CodeConflict, "Agreement " + agreementId + " has no open dispute.")
+	}
+	dispute := &res.Disputes[len(res.Disputes) - 1]
+	// each outcome closes the agreement or puts it back where it was
+	var newStatus string
+	if outcome == common.OutcomeFullPay || outcome == common.OutcomePartialPay {
+		newStatus = common.StatusAccepted
+	}else if outcome == common.OutcomeRefund {
+		newStatus = common.StatusCancelled
+	}else if outcome == common.OutcomePenalty {
+		newStatus = dispute.StatusBeforeDispute
+	}else {
+		return common.RaiseError(stub, common.CodeValidation, "Unknown outcome " + outcome + ". Expecting Full Pay, Partial Pay, Refund or Penalty.")
+	}
+	transition, err := findTransition(res.Status, newStatus)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	if !transition.performableBy(partyOf(res, arbiterId)) {
+		return common.RejectUnauthorized(stub, "Only the arbiter of agreement " + agreementId + " can resolve its dispute.")
+	}
+	// partial pay and penalty outcomes come with an amount, the others are decided by the agreement itself
+	outstanding := common.Money{Amount: res.DueAmount.Amount - res.PaidAmount.Amount, Currency: res.DueAmount.Currency}
+	amount := common.Money{Currency: res.DueAmount.Currency}
+	if outcome == common.OutcomePartialPay || outcome == common.OutcomePenalty {
+		amount, err = common.ParseAmountField("amount", amountArg, res.DueAmount.Currency)
+		if err != nil {
+			return common.Raise(stub, err)
+		}
+		if !amount.IsPositive() {
+			return common.RaiseError(stub, common.CodeValidation, "The amount of a " + outcome + " outcome must be positive.")
+		}
+		if outcome == common.OutcomePartialPay && amount.Amount > outstanding.Amount {
+			return common.RaiseError(stub, common.CodeValidation, "A partial pay cannot be more than the " + outstanding.String() + " still due.")
+		}
+	}else if amountArg != "" {
+		return common.RaiseError(stub, common.CodeValidation, "A " + outcome + " outcome takes no amount.")
+	}else if outcome == common.OutcomeFullPay && outstanding.IsPositive() {
+		amount = outstanding
+	}
+	currentTime, err := common.TxTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = settleDispute(stub, &res, outcome, amount, paymentChaincode, accountChaincode)
+	if err != nil {
+		return nil, err
+	}
+	if outcome == common.OutcomePenalty {
+		resumeAfterDispute(&res, *dispute, currentTime)
+	}
+	dispute.Status = common.DisputeResolved
+	dispute.Outcome = outcome
+	dispute.OutcomeAmount = amount
+	dispute.Notes = notes
+	dispute.ResolvedBy = arbiterId
+	dispute.ResolvedDate = currentTime
+	res.Status = newStatus
+	res.LastUpdatedBy = arbiterId
+	res.LastUpdateDate = currentTime
+	err = saveAgreement(stub, res)
+	if err != nil {
+		return nil, err
+	}
+	err = common.EmitEvent(stub, common.EventAgreementStatusChanged, agreementId, &common.AgreementStatusChanged{
+		AgreementId: agreementId,
+		From: common.StatusDisputed,
+		To: newStatus,
+		UpdatedBy: arbiterId,
+		DisputeId: dispute.DisputeId,
+		Reason: outcome,
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Dispute " + dispute.DisputeId + " of " + agreementId + " resolved: " + outcome)
+	return nil, nil
+}
+
+// ============================================================================================================================
+// settleDispute - make the transfers a dispute outcome decides. Payments to the Service Provider come out of the escrow
+// hold first; whatever is still held once the agreement is closed goes back to the Customer.
+// ============================================================================================================================
+func settleDispute(stub shim.ChaincodeStubInterface, res *common.Service_agreement, outcome string, amount common.Money, paymentChaincode string, accountChaincode string) error {
+	if outcome == common.OutcomePenalty {
+		_, err := payAndRecord(stub, accountChaincode, paymentChaincode, *res, common.OperationPenalty, common.PaymentPenalty, amount, "")
+		if err != nil {
+			return err
+		}
+		res.PenaltyCharged.Amount = res.PenaltyCharged.Amount + amount.Amount
+		return nil
+	}
+	if outcome == common.OutcomeFullPay || outcome == common.OutcomePartialPay {
+		fromHold := amount
+		if fromHold.Amount > res.HeldAmount.Amount {
+			fromHold.Amount = res.HeldAmount.Amount
+		}
+		err := settleHeldAmount(stub, res, true, common.PaymentDisputeSettlement, fromHold, paymentChaincode, accountChaincode)
+		if err != nil {
+			return err
+		}
+		direct := common.Money{Amount: amount.Amount - fromHold.Amount, Currency: amount.Currency}
+		if direct.IsPositive() {
+			_, err = payAndRecord(stub, accountChaincode, paymentChaincode, *res, common.OperationFinal, common.PaymentDisputeSettlement, direct, res.InitialPaymentId)
+			if err != nil {
+				return err
+			}
+			res.PaidAmount.Amount = res.PaidAmount.Amount + direct.Amount
+		}
+		return settleHeldAmount(stub, res, false, common.PaymentDisputeRefund, res.HeldAmount, paymentChaincode, accountChaincode)
+	}
+	// a refund gives back everything held and everything paid other than for accepted milestones, with no cancellation fee
+	err := settleHeldAmount(stub, res, false, common.PaymentDisputeRefund, res.HeldAmount, paymentChaincode, accountChaincode)
+	if err != nil {
+		return err
+	}
+	refund := common.Money{Amount: res.PaidAmount.Amount - acceptedMilestonesTotal(*res).Amount, Currency: res.PaidAmount.Currency}
+	if !refund.IsPositive() {
+		return nil
+	}
+	_, err = payAndRecord(stub, accountChaincode, paymentChaincode, *res, common.OperationRefund, common.PaymentDisputeRefund, refund, res.InitialPaymentId)
+	if err != nil {
+		return err
+	}
+	res.PaidAmount.Amount = res.PaidAmount.Amount - refund.Amount
+	return nil
+}
+
+// ============================================================================================================================
+// checkEvidenceHashes - check that the evidence of a dispute is a list of hex SHA-256 digests
+// ============================================================================================================================
+func checkEvidenceHashes(evidenceHashes []string) ([]string, error) {
+	if evidenceHashes == nil {
+		return []string{}, nil
+	}
+	for _, evidenceHash := range evidenceHashes {
+		digest, err := hex.DecodeString(evidenceHash)
+		if err != nil || len(digest) != 32 {
+			return nil, common.NewError(common.CodeValidation, "Evidence hash " + evidenceHash + " is not a hex SHA-256 digest.")
+		}
+	}
+	return evidenceHashes, nil
+}
+
+// ============================================================================================================================
+// getDisputes - query every dispute raised on an agreement
+// ============================================================================================================================
+func (t *ManageAgreement) getDisputes(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return common.RaiseError(stub, common.CodeValidation, "Incorrect number of arguments. Expecting Agreement Id.")
+	}
+	res, err := loadAgreement(stub, args[0])
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	// disputes are read by the parties, the arbiter and admins
+	caller, err := common.GetIdentity(stub)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	if !caller.HasRole(common.RoleAdmin) && partyOf(res, caller.OwnerId) == "" {
+		return common.RejectUnauthorized(stub, caller.OwnerId + " is not a party of agreement " + res.AgreementID + ".")
+	}
+	return json.Marshal(map[string]interface{}{"agreementId": res.AgreementID, "status": res.Status, "arbiterId": res.ArbiterId, "disputes": res.Disputes})
+}
+
+// ============================================================================================================================
+// resumeAfterDispute - move the acceptance window and the penalty clock of an agreement going back to where it was before
+// a dispute forward by the time the dispute was open. Nothing could be accepted or paid meanwhile, so that time counts
+// against neither party.
+// ============================================================================================================================
+func resumeAfterDispute(res *common.Service_agreement, dispute common.Dispute, currentTime int64) {
+	paused := currentTime - dispute.RaisedDate
+	if paused <= 0 {
+		return
+	}
+	if res.AutoAcceptDate != 0 {
+		res.AutoAcceptDate = res.AutoAcceptDate + paused
+	}
+	if res.PenaltyStartDate != 0 {
+		res.PenaltyStartDate = res.PenaltyStartDate + paused
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+"testing"
+
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+func TestResumeAfterDisputeShiftsClocks(t *testing.T) {
+	day := int64(24 * 60 * 60)
+	res := common.Service_agreement{
+		Status: common.StatusDisputed,
+		PenaltyAmount: common.Money{Amount: 1000, Currency: "USD"},
+		PenaltyTimePeriod: day,
+		PenaltyStartDate: 10 * day,
+		WorkSubmittedDate: 12 * day,
+		AutoAcceptDate: 15 * day,
+	}
+	// raised a day into the acceptance window, open for five days
+	dispute := common.Dispute{RaisedDate: 13 * day, StatusBeforeDispute: common.StatusWorkSubmitted}
+	resolved := 18 * day
+	resumeAfterDispute(&res, dispute, resolved)
+
+	if res.AutoAcceptDate != 20 * day {
+		t.Errorf("AutoAcceptDate = day %d, want day 20", res.AutoAcceptDate / day)
+	}
+	if res.PenaltyStartDate != 15 * day {
+		t.Errorf("PenaltyStartDate = day %d, want day 15", res.PenaltyStartDate / day)
+	}
+	// three days ran before the dispute, the five it was open are not charged
+	penalty, periods := duePenalty(res, resolved)
+	if len(periods) != 3 || penalty.Amount != 3000 {
+		t.Errorf("penalty on resolution = %v for periods %v, want 30.00 USD for 3 periods", penalty, periods)
+	}
+}
+
+func TestResumeAfterDisputeKeepsUnsetClocks(t *testing.T) {
+	res := common.Service_agreement{}
+	resumeAfterDispute(&res, common.Dispute{RaisedDate: 100}, 500)
+	if res.AutoAcceptDate != 0 || res.PenaltyStartDate != 0 {
+		t.Errorf("unset clocks moved to %d and %d", res.AutoAcceptDate, res.PenaltyStartDate)
+	}
+}
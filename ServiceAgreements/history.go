@@ -0,0 +1,38 @@
+package main
+
+import (
+"fmt"
+"encoding/json"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+// ============================================================================================================================
+// getServiceAgreementHistory - fetch every version of an agreement with the transaction, time and identity that stored it
+// and the fields it changed. Auditors can read the history of any agreement, everyone else only of the agreements they
+// are a party or the arbiter of.
+// ============================================================================================================================
+func (t *ManageAgreement) getServiceAgreementHistory(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return common.RaiseError(stub, common.CodeValidation, "Incorrect number of arguments. Expecting \"Agreement Id\" as an argument.")
+	}
+	agreementId := args[0]
+	res, err := loadAgreement(stub, agreementId)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	caller, err := common.GetIdentity(stub)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	if !caller.HasRole(common.RoleAdmin, common.RoleAuditor) && partyOf(res, caller.OwnerId) == "" {
+		return common.RejectUnauthorized(stub, caller.OwnerId + " is not a party of agreement " + agreementId + ".")
+	}
+	history, err := common.GetHistory(stub, AgreementObjectType, agreementId)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Fetched the history of agreement " + agreementId)
+	return json.Marshal(map[string]interface{}{"agreementId": agreementId, "history": history})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+"encoding/json"
+"fmt"
+"strconv"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+// ============================================================================================================================
+// listServiceAgreements - query a page of the agreements the caller may see, filtered and sorted as asked in the optional
+// JSON argument (see common.ListRequest). The date filter and sort use the StartDate, the amount ones the DueAmount.
+// Every stored agreement is read and decoded on each call and the matches are sorted and paged in memory, because the
+// range queries of this Fabric version can neither sort on a field nor count the matches they skip; the cost of a page
+// grows with the number of agreements stored, whatever the pageSize.
+// ============================================================================================================================
+func (t *ManageAgreement) listServiceAgreements(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) > 1 {
+		return common.RaiseError(stub, common.CodeValidation, "Incorrect number of arguments. Expecting the list request in JSON, or nothing.")
+	}
+	request, err := common.ParseListRequest(optionalArg(args, 0))
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	// admins see every agreement, everyone else only the agreements they are a party or the arbiter of
+	caller, err := common.GetIdentity(stub)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	items := []common.ListItem{}
+	err = common.ScanPartialCompositeKey(stub, AgreementObjectType, []string{}, func(key string, attributes []string, valueAsBytes []byte) error {
+		res := common.Service_agreement{}
+		err := json.Unmarshal(valueAsBytes, &res)
+		if err != nil {
+			return err
+		}
+		if !caller.HasRole(common.RoleAdmin) && partyOf(res, caller.OwnerId) == "" {
+			return nil
+		}
+		item := common.ListItem{
+			Id: res.AgreementID,
+			Status: res.Status,
+			CustomerId: res.CustomerId,
+			ServiceProviderId: res.ServiceProviderId,
+			Date: res.StartDate,
+			Amount: res.DueAmount,
+			Record: valueAsBytes,
+		}
+		if request.Matches(item) {
+			items = append(items, item)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	page, err := request.Page(items)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	fmt.Println("Listed " + strconv.Itoa(page.Count) + " of " + strconv.Itoa(page.Total) + " agreements")
+	return json.Marshal(page)
+}
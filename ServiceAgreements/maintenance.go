@@ -0,0 +1,151 @@
+package main
+
+import (
+"errors"
+"fmt"
+"strconv"
+"encoding/json"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+// ============================================================================================================================
+// resetState - admin function for test networks to delete every agreement. The registered Payment and Account chaincodes
+// are kept. The caller must pass common.ResetConfirmation to show it means it.
+// ============================================================================================================================
+func (t *ManageAgreement) resetState(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 || args[0] != common.ResetConfirmation {
+		return common.RaiseError(stub, common.CodeValidation, "Resetting deletes every agreement. Pass \"" + common.ResetConfirmation + "\" to confirm.")
+	}
+	deleted, err := common.ResetState(stub, map[string]bool{CounterpartiesStr: true})
+	if err != nil {
+		return nil, err
+	}
+	err = common.EmitEvent(stub, common.EventAdminActionPerformed, "", &common.AdminActionPerformed{
+		Chaincode: "ManageAgreement",
+		Action: "resetState",
+		Details: map[string]string{"keysDeleted": strconv.Itoa(deleted)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("ManageAgreement state reset, " + strconv.Itoa(deleted) + " keys deleted")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// migrateKeys - admin function moving the agreements of the earlier key layout to their composite keys and indexing them
+// under their parties, then deleting the JSON array index that listed them. Every plain key is looked at, so that
+// agreements missing from the index are moved too. Running it again once everything was moved does nothing.
+// ============================================================================================================================
+func (t *ManageAgreement) migrateKeys(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	keys, err := common.ListPlainKeys(stub)
+	if err != nil {
+		return nil, err
+	}
+	migrated := 0
+	for _, key := range keys {
+		if key == ServiceAgreementIndexStr {
+			err = stub.DelState(key)							//replaced by the range scans over agreement~id
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		moved, err := migrateAgreement(stub, key)
+		if err != nil {
+			return nil, err
+		}
+		if moved {
+			migrated++
+		}
+	}
+	err = common.EmitEvent(stub, common.EventAdminActionPerformed, "", &common.AdminActionPerformed{
+		Chaincode: "ManageAgreement",
+		Action: "migrateKeys",
+		Details: map[string]string{"agreementsMigrated": strconv.Itoa(migrated)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println(strconv.Itoa(migrated) + " agreements moved to composite keys")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// migrateAgreement - move the agreement stored under a plain key to its composite key. Other plain keys, such as the
+// registered Payment and Account chaincodes, are settings and stay where they are. The agreement is stored again in its
+// current format, with the amounts it was paid filled in, and gets a first history entry.
+// ============================================================================================================================
+func migrateAgreement(stub shim.ChaincodeStubInterface, key string) (bool, error) {
+	agreementAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return false, errors.New("Failed to get state for " + key)
+	}
+	record := struct{
+		AgreementID string
+	}{}
+	if len(agreementAsBytes) == 0 || json.Unmarshal(agreementAsBytes, &record) != nil || record.AgreementID != key {
+		return false, nil
+	}
+	res := common.Service_agreement{}
+	err = json.Unmarshal(agreementAsBytes, &res)
+	if err != nil {
+		return false, errors.New("Agreement " + key + " cannot be read: " + err.Error())
+	}
+	agreementAsBytes, err = json.Marshal(res)
+	if err != nil {
+		return false, err
+	}
+	err = putAgreementState(stub, key, agreementAsBytes)
+	if err != nil {
+		return false, err
+	}
+	err = stub.DelState(key)
+	if err != nil {
+		return false, err
+	}
+	return true, indexAgreementParties(stub, res)
+}
+
+// ============================================================================================================================
+// rebuildIndexes - admin function that drops the party~id index and writes it again from the stored agreements, e.g. after
+// an index entry was lost or agreements were stored before the index existed
+// ============================================================================================================================
+func (t *ManageAgreement) rebuildIndexes(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	_, err := common.DeleteCompositeKeys(stub, PartyAgreementIndex)
+	if err != nil {
+		return nil, err
+	}
+	agreements := []common.Service_agreement{}
+	err = common.ScanPartialCompositeKey(stub, AgreementObjectType, []string{}, func(key string, attributes []string, valueAsBytes []byte) error {
+		res := common.Service_agreement{}
+		err := common.DecodeState(valueAsBytes, "Agreement " + attributes[0], &res)
+		if err != nil {
+			return err
+		}
+		agreements = append(agreements, res)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the index is written once the scan is done, so that the scan does not see its own writes
+	for _, res := range agreements {
+		err = indexAgreementParties(stub, res)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = common.EmitEvent(stub, common.EventAdminActionPerformed, "", &common.AdminActionPerformed{
+		Chaincode: "ManageAgreement",
+		Action: "rebuildIndexes",
+		Details: map[string]string{"agreementsIndexed": strconv.Itoa(len(agreements))},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Party index rebuilt from " + strconv.Itoa(len(agreements)) + " agreements")
+	return nil, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+"encoding/json"
+"sort"
+"testing"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+// stateStub is a fakeStub with a state kept in memory, range queries over it and the certificate of an admin
+type stateStub struct{
+	fakeStub
+	state map[string][]byte
+}
+
+func newStateStub() *stateStub {
+	return &stateStub{state: map[string][]byte{}}
+}
+
+func (stub *stateStub) GetState(key string) ([]byte, error) {
+	return stub.state[key], nil
+}
+
+func (stub *stateStub) PutState(key string, value []byte) error {
+	stub.state[key] = value
+	return nil
+}
+
+func (stub *stateStub) DelState(key string) error {
+	delete(stub.state, key)
+	return nil
+}
+
+func (stub *stateStub) RangeQueryState(startKey string, endKey string) (shim.StateRangeQueryIteratorInterface, error) {
+	keys := []string{}
+	for key := range stub.state {
+		if key >= startKey && key <= endKey {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return &stateIterator{stub, keys}, nil
+}
+
+func (stub *stateStub) ReadCertAttribute(attributeName string) ([]byte, error) {
+	attributes := map[string]string{common.OwnerIdAttribute: "admin", common.RoleAttribute: common.RoleAdmin, common.OrganizationAttribute: "Office Depot"}
+	return []byte(attributes[attributeName]), nil
+}
+
+type stateIterator struct{
+	stub *stateStub
+	keys []string
+}
+
+func (iterator *stateIterator) HasNext() bool {
+	return len(iterator.keys) > 0
+}
+
+func (iterator *stateIterator) Next() (string, []byte, error) {
+	key := iterator.keys[0]
+	iterator.keys = iterator.keys[1:]
+	return key, iterator.stub.state[key], nil
+}
+
+func (iterator *stateIterator) Close() error {
+	return nil
+}
+
+func TestMigrateKeysMovesBaselineAgreements(t *testing.T) {
+	stub := newStateStub()
+	// the layout the baseline chaincode wrote: agreements under their plain Id with float amounts, listed in a JSON array.
+	// SA2 is missing from the index and is moved all the same.
+	stub.state[ServiceAgreementIndexStr] = []byte(`["SA1"]`)
+	stub.state["SA1"] = []byte(`{"AgreementID":"SA1","Status":"Pending Start","CustomerId":"C1","ServiceProviderId":"S1","StartDate":1500000000,"EndDate":1600000000,"DueAmount":1000,"InitialPaymentPercentage":0.2,"PenaltyAmount":10.5,"PenaltyTimePeriod":86400,"LastUpdatedBy":"C1","LastUpdateDate":1500000000}`)
+	stub.state["SA2"] = []byte(`{"AgreementID":"SA2","Status":"Pending Customer Acceptance","CustomerId":"C1","ServiceProviderId":"S2","DueAmount":250.75,"InitialPaymentPercentage":0.1}`)
+	stub.state[CounterpartiesStr] = []byte(`{"paymentChaincode":"payments","accountChaincode":"accounts"}`)
+
+	manager := &ManageAgreement{}
+	_, err := manager.migrateKeys(common.RecordEvents(stub), []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{ServiceAgreementIndexStr, "SA1", "SA2"} {
+		if _, ok := stub.state[key]; ok {
+			t.Errorf("plain key %q is still stored", key)
+		}
+	}
+	if _, ok := stub.state[CounterpartiesStr]; !ok {
+		t.Errorf("the registered chaincodes were moved")
+	}
+
+	agreementAsBytes, _ := getAgreementState(stub, "SA1")
+	stored := map[string]json.RawMessage{}
+	err = json.Unmarshal(agreementAsBytes, &stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stored["DueAmount"]) != `{"amount":100000,"currency":"USD"}` {
+		t.Errorf("stored DueAmount = %s, want the current Money format", stored["DueAmount"])
+	}
+	res := common.Service_agreement{}
+	err = json.Unmarshal(agreementAsBytes, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.InitialPaymentPercentage != 2000 || res.PenaltyAmount != usd(1050) || res.PaidAmount != usd(20000) || res.HeldAmount != usd(0) {
+		t.Errorf("migrated SA1 = %+v", res)
+	}
+
+	history, err := common.GetHistory(stub, AgreementObjectType, "SA1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].TxId != "tx1" {
+		t.Errorf("history of SA1 = %+v, want the migration as its first version", history)
+	}
+	for _, partyId := range []string{"C1", "S2"} {
+		key, _ := common.CreateCompositeKey(PartyAgreementIndex, partyId, "SA2")
+		if _, ok := stub.state[key]; !ok {
+			t.Errorf("SA2 is not indexed under %s", partyId)
+		}
+	}
+
+	// a second run finds nothing left to move
+	before := len(stub.state)
+	_, err = manager.migrateKeys(common.RecordEvents(stub), []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.state) != before {
+		t.Errorf("second migration changed the state from %d to %d keys", before, len(stub.state))
+	}
+}
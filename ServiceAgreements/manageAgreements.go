@@ -24,42 +24,17 @@ import (
 "fmt"
 "strconv"
 "encoding/json"
-"time"
 "github.com/hyperledger/fabric/core/chaincode/shim"
-"github.com/hyperledger/fabric/core/util"
+"github.com/Dimple-Kanwar/Office-Depot/common"
 )
 
 // ManageAgreement example simple Chaincode implementation
 type ManageAgreement struct {
 }
 
-var ServiceAgreementIndexStr = "_ServiceAgreementIndexStr"
-
-type Service_agreement struct{
-	AgreementID string
-	Status string
-	CustomerId string
-	ServiceProviderId string
-	StartDate int64
-	EndDate int64
-	DueAmount float64
-	InitialPaymentPercentage float64
-	PenaltyAmount float64
-	PenaltyTimePeriod int64
-	LastUpdatedBy string
-	LastUpdateDate int64
-}
-
-type Payment struct{
-	PaymentId string
-	AgreementId string
-	PaymentType string
-	CustomerAccount string
-	ReceiverAccount string
-	AmountPaid float64
-	LastUpdatedBy string
-	LastUpdateDate int64
-}
+var AgreementObjectType = "agreement~id"						//agreements are stored under the composite key (agreement~id, agreementId)
+var PartyAgreementIndex = "party~id"							//index entry (party~id, partyId) for the Customer and the Service Provider of each agreement
+var ServiceAgreementIndexStr = "_ServiceAgreementIndexStr"		//key/value that stored the list of all agreements before they had composite keys
 
 // ============================================================================================================================
 // Main - start the chaincode for Agreement management
@@ -73,26 +48,37 @@ func main() {
 // ============================================================================================================================
 // Init - reset all the things
 // ============================================================================================================================
-func (t *ManageAgreement) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	var err error
-	if len(args) != 1 {
-		errMsg := "{ \"message\" : \"Incorrect number of arguments. Expecting \"Intial_Value\" as an argument\", \"code\" : \"503\"}"
-		err = stub.SetEvent("errEvent", []byte(errMsg))
+func (t *ManageAgreement) Init(stub shim.ChaincodeStubInterface, function string, args []string) (result []byte, err error) {
+	// the events of a call that succeeded are set together as one event
+	recorder := common.RecordEvents(stub)
+	stub = recorder
+	defer func() {
+		if err == nil {
+			err = recorder.Publish("init")
+		}
 		if err != nil {
-			return nil, err
+			err = common.AsError(err)
 		}
-		return nil, nil
+	}()
+	// only an admin may initialize the chaincode
+	_, err = common.RequireRole(stub, common.RoleAdmin)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
 	}
-
-	var empty []string
-	jsonAsBytes, _ := json.Marshal(empty)								//marshal an emtpy array of strings to clear the index
-	err = stub.PutState(ServiceAgreementIndexStr, jsonAsBytes)
+	if len(args) != 2 {
+		return common.RaiseError(stub, common.CodeValidation, "Incorrect number of arguments. Expecting the Payment chaincode and Account chaincode names as arguments")
+	}
+	// funds are only ever moved through the chaincodes registered here, never through names given by callers
+	err = setCounterparties(stub, args[0], args[1])
 	if err != nil {
 		return nil, err
 	}
 
-	tosend := "{ \"message\" : \"ManageAgreement chaincode is deployed successfully.\", \"code\" : \"200\"}"
-	err = stub.SetEvent("evtsender", []byte(tosend))
+	err = common.EmitEvent(stub, common.EventAdminActionPerformed, "", &common.AdminActionPerformed{
+		Chaincode: "ManageAgreement",
+		Action: "init",
+		Details: map[string]string{"paymentChaincode": args[0], "accountChaincode": args[1]},
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -109,11 +95,29 @@ func (t *ManageAgreement) Run(stub shim.ChaincodeStubInterface, function string,
 // ============================================================================================================================
 // Invoke - Our entry agreementint for Invocations
 // ============================================================================================================================
-func (t *ManageAgreement) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+func (t *ManageAgreement) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) (result []byte, err error) {
+	// every failure reaches the caller as a common.Error with its code, the events of a call that succeeded are set
+	// together as one event
+	recorder := common.RecordEvents(stub)
+	stub = recorder
+	defer func() {
+		if err == nil {
+			err = recorder.Publish(function)
+		}
+		if err != nil {
+			err = common.AsError(err)
+		}
+	}()
 	fmt.Println("invoke is running " + function)
 
+	// only the roles in the invoke policy may call a function, and functions missing from it cannot be called
+	_, err = invokePolicy.Authorize(stub, function)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+
 	// Handle different functions
-	if function == "init" {													//initialize the chaincode state, used as reset
+	if function == "init" {													//initialize the chaincode state, existing data is kept
 		return t.Init(stub, "init", args)
 	}else if function == "createServiceAgreement" {											//create a new Service Agreement
 		return t.createServiceAgreement(stub, args)
@@ -121,261 +125,440 @@ func (t *ManageAgreement) Invoke(stub shim.ChaincodeStubInterface, function stri
 		return t.updateServiceAgreement(stub, args)
 	}else if function == "checkPenalty" {											//update Service Agreement
 		return t.checkPenalty(stub, args)
+	}else if function == "rejectServiceAgreement" {									//Customer rejects a new Service Agreement
+		return t.rejectServiceAgreement(stub, args)
+	}else if function == "cancelServiceAgreement" {									//either party cancels, refunding the Customer
+		return t.cancelServiceAgreement(stub, args)
+	}else if function == "completeMilestone" {										//Service Provider reports a milestone as done
+		return t.completeMilestone(stub, args)
+	}else if function == "acceptMilestone" {										//Customer accepts a milestone and pays for it
+		return t.acceptMilestone(stub, args)
+	}else if function == "raiseDispute" {											//either party disputes the agreement, freezing its payments
+		return t.raiseDispute(stub, args)
+	}else if function == "resolveDispute" {											//the arbiter resolves an open dispute
+		return t.resolveDispute(stub, args)
+	}else if function == "rotateCounterparties" {									//admin: change the Payment and Account chaincodes
+		return t.rotateCounterparties(stub, args)
+	}else if function == "resetState" {												//admin: wipe all agreements on a test network
+		return t.resetState(stub, args)
+	}else if function == "migrateKeys" {											//admin: move agreements from the array index to composite keys
+		return t.migrateKeys(stub, args)
+	}else if function == "rebuildIndexes" {										//admin: write the party~id index again
+		return t.rebuildIndexes(stub, args)
 	}
 	fmt.Println("invoke did not find func: " + function)					//error
-	errMsg := "{ \"message\" : \"Received unknown function invocation\", \"code\" : \"503\"}"
-	err := stub.SetEvent("errEvent", []byte(errMsg))
-	if err != nil {
-		return nil, err
-	}
-	return nil, nil
+	return common.RaiseError(stub, common.CodeValidation, "Received unknown function invocation")
 }
 // ============================================================================================================================
 // Query - Our entry agreementint for Queries
 // ============================================================================================================================
-func (t *ManageAgreement) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+func (t *ManageAgreement) Query(stub shim.ChaincodeStubInterface, function string, args []string) (result []byte, err error) {
+	defer func() {
+		if err != nil {
+			err = common.AsError(err)
+		}
+	}()
 	fmt.Println("query is running " + function)
 
+	// only the roles in the query policy may call a function, and functions missing from it cannot be called
+	_, err = queryPolicy.Authorize(stub, function)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+
 	// Handle different functions
 	if function == "getAll_ServiceAgreement" {													//Read all Service Agreements
 		return t.getAll_ServiceAgreement(stub, args)
+	}else if function == "getServiceAgreementById" {									//Read a single Service Agreement
+		return t.getServiceAgreementById(stub, args)
+	}else if function == "getAgreementsByParty" {										//Read the agreements of a Customer or Service Provider
+		return t.getAgreementsByParty(stub, args)
+	}else if function == "getServiceAgreementHistory" {									//Read every version of a Service Agreement
+		return t.getServiceAgreementHistory(stub, args)
+	}else if function == "listServiceAgreements" {										//Read a page of Service Agreements
+		return t.listServiceAgreements(stub, args)
+	}else if function == "getAllowedTransitions" {										//Read the next states of an agreement
+		return t.getAllowedTransitions(stub, args)
+	}else if function == "getDisputes" {												//Read the disputes of an agreement
+		return t.getDisputes(stub, args)
+	}else if function == "getCounterpartyChaincodes" {									//Read the Payment and Account chaincodes
+		return t.getCounterpartyChaincodes(stub, args)
 	}
 
 	fmt.Println("query did not find func: " + function)						//error
-	errMsg := "{ \"message\" : \"Received unknown function query\", \"code\" : \"503\"}"
-	err := stub.SetEvent("errEvent", []byte(errMsg))
+	return common.RaiseError(stub, common.CodeValidation, "Received unknown function query")
+}
+// agreementRequest is the JSON argument of createServiceAgreement. Amounts are decimal strings in the agreement currency,
+// dates unix seconds.
+type agreementRequest struct{
+	CustomerId string `json:"customerId"`
+	ServiceProviderId string `json:"serviceProviderId"`
+	Currency string `json:"currency"`
+	StartDate int64 `json:"startDate"`
+	EndDate int64 `json:"endDate"`
+	DueAmount string `json:"dueAmount"`
+	InitialPaymentPercentage string `json:"initialPaymentPercentage"` // % of the DueAmount, 0 or left out for milestone agreements
+	PenaltyAmount string `json:"penaltyAmount"` // charged per late period, "0" for no penalty
+	PenaltyTimePeriod int64 `json:"penaltyTimePeriod"` // seconds
+	PenaltyCap string `json:"penaltyCap"` // optional, no cap when left out
+	CancellationFee string `json:"cancellationFee"` // optional
+	Milestones []milestoneRequest `json:"milestones"` // optional payment schedule
+	ArbiterId string `json:"arbiterId"` // optional, disputes cannot be raised without one
+	AcceptanceWindow int64 `json:"acceptanceWindow"` // seconds, DefaultAcceptanceWindow when left out
+	IdempotencyKey string `json:"idempotencyKey"` // a retried request with the same key resolves to the agreement created the first time
+}
+
+// ============================================================================================================================
+// parseAgreementRequest - decode and validate the JSON argument of createServiceAgreement into the agreement it describes
+// ============================================================================================================================
+func parseAgreementRequest(args []string) (agreementRequest, common.Service_agreement, error) {
+	request := agreementRequest{}
+	agreement := common.Service_agreement{}
+	err := common.DecodePayload(args, "agreement", &request)
 	if err != nil {
-		return nil, err
+		return request, agreement, err
 	}
-	return nil, nil
+	if request.CustomerId == "" {
+		return request, agreement, common.MissingField("customerId")
+	}
+	if request.ServiceProviderId == "" {
+		return request, agreement, common.MissingField("serviceProviderId")
+	}
+	if request.CustomerId == request.ServiceProviderId {
+		return request, agreement, common.NewError(common.CodeValidation, "customerId and serviceProviderId must be different.")
+	}
+	if request.Currency == "" {
+		return request, agreement, common.MissingField("currency")
+	}
+	if _, err := common.Digits(request.Currency); err != nil {
+		return request, agreement, common.FieldError("currency", err)
+	}
+	if request.StartDate <= 0 {
+		return request, agreement, common.NewError(common.CodeValidation, "startDate is required, in unix seconds.")
+	}
+	if request.EndDate <= 0 {
+		return request, agreement, common.NewError(common.CodeValidation, "endDate is required, in unix seconds.")
+	}
+	if request.EndDate <= request.StartDate {
+		return request, agreement, common.NewError(common.CodeValidation, "endDate must be after startDate.")
+	}
+	currency := request.Currency
+	dueAmount, err := common.ParseAmountField("dueAmount", request.DueAmount, currency)
+	if err != nil {
+		return request, agreement, err
+	}
+	if !dueAmount.IsPositive() {
+		return request, agreement, common.NewError(common.CodeValidation, "dueAmount must be positive.")
+	}
+	// milestone agreements pay per accepted milestone instead of an initial payment
+	var initialPaymentPercentage common.Percentage
+	milestones := []common.Milestone{}
+	if len(request.Milestones) > 0 {
+		milestones, err = parseMilestones(request.Milestones, dueAmount, request.StartDate, request.EndDate)
+		if err != nil {
+			return request, agreement, err
+		}
+		if request.InitialPaymentPercentage != "" {
+			initialPaymentPercentage, err = common.ParsePercentageField("initialPaymentPercentage", request.InitialPaymentPercentage)
+			if err != nil {
+				return request, agreement, err
+			}
+		}
+		if initialPaymentPercentage != 0 {
+			return request, agreement, common.NewError(common.CodeValidation, "initialPaymentPercentage must be 0 for an agreement paid by milestones.")
+		}
+	}else {
+		initialPaymentPercentage, err = common.ParsePercentageField("initialPaymentPercentage", request.InitialPaymentPercentage)
+		if err != nil {
+			return request, agreement, err
+		}
+	}
+	penaltyAmount, err := common.ParseAmountField("penaltyAmount", request.PenaltyAmount, currency)
+	if err != nil {
+		return request, agreement, err
+	}
+	if penaltyAmount.IsNegative() {
+		return request, agreement, common.NewError(common.CodeValidation, "penaltyAmount cannot be negative.")
+	}
+	if request.PenaltyTimePeriod < 0 || (penaltyAmount.IsPositive() && request.PenaltyTimePeriod == 0) {
+		return request, agreement, common.NewError(common.CodeValidation, "penaltyTimePeriod must be a positive number of seconds when a penalty is charged.")
+	}
+	penaltyCap := common.Money{Currency: currency}
+	if request.PenaltyCap != "" {
+		penaltyCap, err = common.ParseAmountField("penaltyCap", request.PenaltyCap, currency)
+		if err != nil {
+			return request, agreement, err
+		}
+		if penaltyCap.IsNegative() {
+			return request, agreement, common.NewError(common.CodeValidation, "penaltyCap cannot be negative.")
+		}
+	}
+	cancellationFee := common.Money{Currency: currency}
+	if request.CancellationFee != "" {
+		cancellationFee, err = common.ParseAmountField("cancellationFee", request.CancellationFee, currency)
+		if err != nil {
+			return request, agreement, err
+		}
+		if cancellationFee.IsNegative() {
+			return request, agreement, common.NewError(common.CodeValidation, "cancellationFee cannot be negative.")
+		}
+	}
+	// the arbiter resolves disputes between the parties, so it cannot be one of them
+	if request.ArbiterId != "" && (request.ArbiterId == request.CustomerId || request.ArbiterId == request.ServiceProviderId) {
+		return request, agreement, common.NewError(common.CodeValidation, "arbiterId cannot be the Customer or Service Provider of the agreement.")
+	}
+	// seconds the Customer has to accept submitted work
+	acceptanceWindow := DefaultAcceptanceWindow
+	if request.AcceptanceWindow < 0 {
+		return request, agreement, common.NewError(common.CodeValidation, "acceptanceWindow must be a positive number of seconds.")
+	}else if request.AcceptanceWindow > 0 {
+		acceptanceWindow = request.AcceptanceWindow
+	}
+	agreement = common.Service_agreement{
+		CustomerId: request.CustomerId,
+		ServiceProviderId: request.ServiceProviderId,
+		Currency: currency,
+		StartDate: request.StartDate,
+		EndDate: request.EndDate,
+		DueAmount: dueAmount,
+		InitialPaymentPercentage: initialPaymentPercentage,
+		PenaltyAmount: penaltyAmount,
+		PenaltyTimePeriod: request.PenaltyTimePeriod,
+		PenaltyCap: penaltyCap,
+		CancellationFee: cancellationFee,
+		Milestones: milestones,
+		ArbiterId: request.ArbiterId,
+		AcceptanceWindow: acceptanceWindow,
+	}
+	return request, agreement, nil
 }
+
 // ============================================================================================================================
 // createServiceAgreement - create a new Service Agreement, store into chaincode state
 // ============================================================================================================================
 func (t *ManageAgreement) createServiceAgreement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
-	if len(args) != 9 {
-		errMsg := "{ \"message\" : \"Incorrect number of arguments. Expecting 9 arguments.\", \"code\" : \"503\"}"
-		err = stub.SetEvent("errEvent", []byte(errMsg))
+	fmt.Println("creating a new Service Agreement")
+	//input sanitation: the agreement is given as a JSON agreementRequest
+	request, agreement, err := parseAgreementRequest(args)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	// agreements are offered by their Service Provider, or set up by an admin
+	caller, err := common.GetIdentity(stub)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	if !caller.HasRole(common.RoleAdmin) && caller.OwnerId != agreement.ServiceProviderId {
+		return common.RejectUnauthorized(stub, caller.OwnerId + " can only create agreements as their Service Provider.")
+	}
+
+	// setting attributes
+	// the agreement Id is derived from the caller and its idempotency key when given, from the transaction Id otherwise
+	idempotencyKey := request.IdempotencyKey
+	var agreementId string
+	if idempotencyKey != "" {
+		agreementId = common.IdempotentID("SA", caller.OwnerId, idempotencyKey)
+	}else {
+		agreementId, err = common.NewID(stub, "SA", AgreementObjectType)
 		if err != nil {
 			return nil, err
 		}
-		return nil, errors.New(errMsg)
 	}
-	fmt.Println("creating a new Service Agreement")
-	//input sanitation
-	if len(args[0]) <= 0 {
-		return nil, errors.New("Customer Id in an agreement cannot be empty.")
-	}else if len(args[1]) <= 0 {
-		return nil, errors.New("Service Provider Id in an agreement cannot be empty.")
-	}else if len(args[2]) <= 0 {
-		return nil, errors.New("Start Date of a Service agreement cannot be empty")
-	}else if len(args[3]) <= 0 {
-		return nil, errors.New("End Date of a Service agreement cannot be empty.")
-	}else if len(args[4]) <= 0 {
-		return nil, errors.New("Due Amount of a Service agreement cannot be empty.")
-	}else if len(args[5]) <= 0 {
-		return nil, errors.New("Initial Payment Percentage cannot be empty.")
-	}else if len(args[6]) <= 0 {
-		return nil, errors.New("Penalty Amount for a Service agreement cannot be empty.")
-	}else if len(args[7]) <= 0 {
-		return nil, errors.New("Penalty Time Period of a Service agreement cannot be empty.")
-	}else if len(args[8]) <= 0 {
-		return nil, errors.New("Last Updated By cannot be empty.")
+	status := common.StatusPendingCustomerAcceptance
+	currency := agreement.Currency
+	lastUpdatedBy := caller.OwnerId
+	lastUpdateDate, err := common.TxTimestamp(stub) // transaction timestamp
+	if err != nil {
+		return nil, err
 	}
 
-	// setting attributes
-	agreementId := "SA"+ strconv.FormatInt(time.Now().Unix(), 10) // check https://play.golang.org/p/8Du2FrDk2eH
-	status := "Pending Customer Acceptance"
-	customerId := args[0]
-	serviceProviderId := args[1]
-	startDate, _ := strconv.ParseInt(args[2], 10,64)
-	endDate, _ := strconv.ParseInt(args[3], 10,64)
-	dueAmount, _ := strconv.ParseFloat(args[4], 64)
-  initialPayment,_ := strconv.ParseFloat(args[5], 64);
-	initialPaymentPercentage := initialPayment / 100; // % of the Total amount due
-	penaltyAmount, _ := strconv.ParseFloat(args[6], 64)
-	penaltyTime,_	:= strconv.ParseFloat(args[7], 64) // minutes in seconds format
-	penaltyTimePeriod := int64(penaltyTime)
-	lastUpdatedBy := args[8]
-	lastUpdateDate := time.Now().Unix() // current unix timestamp
-
-	fmt.Println(agreementId);
-	fmt.Println(customerId);
-	fmt.Println(serviceProviderId);
-	fmt.Println(status);
-	fmt.Println(startDate);
-	fmt.Println(endDate);
-	fmt.Println(dueAmount);
-	fmt.Println(initialPaymentPercentage);
-	fmt.Println(penaltyAmount);
-	fmt.Println(penaltyTimePeriod);
-	fmt.Println(lastUpdatedBy);
-	fmt.Println(lastUpdateDate);
-
 	// Fetching Service agreement details by agreement Id
-	serviceAgreementAsBytes, err := stub.GetState(agreementId)
+	serviceAgreementAsBytes, err := getAgreementState(stub, agreementId)
+	if err != nil {
+		return common.RaiseError(stub, common.CodeInternal, "Failed to get service agreement Id")
+	}
+	res := common.Service_agreement{}
+	err = common.DecodeState(serviceAgreementAsBytes, "Agreement " + agreementId, &res)
 	if err != nil {
-		return nil, errors.New("Failed to get service agreement Id")
+		return common.Raise(stub, err)
 	}
-	res := Service_agreement{}
-	json.Unmarshal(serviceAgreementAsBytes, &res)
 	fmt.Print("Service Agreement Details: ")
 	fmt.Println(res)
+	if res.AgreementID == agreementId && idempotencyKey != "" {
+		if !sameAgreementTerms(res, agreement) {
+			return common.RaiseError(stub, common.CodeConflict, "Idempotency key " + idempotencyKey + " was already used for agreement " + agreementId + " with different terms.")
+		}
+		fmt.Println("Service agreement already created for this idempotency key: " + agreementId)
+		return []byte(agreementId), nil				//a retried request resolves to the agreement created the first time
+	}
 	if res.AgreementID == agreementId{
 		fmt.Println("This service agreement already exists: " + agreementId)
-		errMsg := "{ \"message\" : \"This service agreement already exists.\", \"code\" : \"503\"}"
-		err := stub.SetEvent("errEvent", []byte(errMsg))
-		if err != nil {
-			return nil, err
-		}
-		return nil, errors.New(errMsg)				//stop creating a new service agreement if agreement exists already
+		return common.RaiseError(stub, common.CodeConflict, "This service agreement already exists.")				//stop creating a new service agreement if agreement exists already
 	}
 
 	// create a pointer/json to the struct 'Service_agreement'
-	serviceAgreementJson := &Service_agreement{agreementId, status, customerId, serviceProviderId, startDate, endDate, dueAmount, initialPaymentPercentage, penaltyAmount, penaltyTimePeriod, lastUpdatedBy, lastUpdateDate}
+	serviceAgreementJson := &agreement
+	serviceAgreementJson.AgreementID = agreementId
+	serviceAgreementJson.Status = status
+	serviceAgreementJson.PenalizedPeriods = []int64{}
+	serviceAgreementJson.PenaltyCharged = common.Money{Currency: currency}
+	serviceAgreementJson.PaidAmount = common.Money{Currency: currency}
+	serviceAgreementJson.HeldAmount = common.Money{Currency: currency}
+	serviceAgreementJson.Disputes = []common.Dispute{}
+	serviceAgreementJson.LastUpdatedBy = lastUpdatedBy
+	serviceAgreementJson.LastUpdateDate = lastUpdateDate
 
 	// convert *Service_agreement to []byte
 	serviceAgreementJsonasBytes, err := json.Marshal(serviceAgreementJson)
 	if err != nil {
 		return nil, err
 	}
-	//store service agreementId as key
-	err = stub.PutState(agreementId, serviceAgreementJsonasBytes)
+	//store under the agreement~id composite key, which is also how agreements are listed
+	err = putAgreementState(stub, agreementId, serviceAgreementJsonasBytes)
 	if err != nil {
 		return nil, err
 	}
-
-	//get the Service Agreement index
-	serviceAgreementIndexStrAsBytes, err := stub.GetState(ServiceAgreementIndexStr)
-	if err != nil {
-		return nil, errors.New("Failed to get Service Agreement index")
-	}
-	var ServiceAgreementIndex []string
-
-	json.Unmarshal(serviceAgreementIndexStrAsBytes, &ServiceAgreementIndex)							//un stringify it aka JSON.parse()
-	fmt.Print("serviceAgreementIndexStrAsBytes after unmarshal..before append: ")
-	fmt.Println(serviceAgreementIndexStrAsBytes)
-
-	//append
-	ServiceAgreementIndex = append(ServiceAgreementIndex, agreementId)									//add agreementId to index list
-	fmt.Println("! Service Agreement index: ", ServiceAgreementIndex)
-	jsonAsBytes, _ := json.Marshal(ServiceAgreementIndex)
-	err = stub.PutState(ServiceAgreementIndexStr, jsonAsBytes)						//store Service Agreement as an index
+	err = indexAgreementParties(stub, *serviceAgreementJson)
 	if err != nil {
 		return nil, err
 	}
 
 	// event message to set on successful service agreement creation
-	tosend := "{ \"Service Agreement Id\" : \""+agreementId+"\", \"message\" : \"Service agreement created succcessfully\", \"code\" : \"200\"}"
-	err = stub.SetEvent("evtsender", []byte(tosend))
+	err = common.EmitEvent(stub, common.EventAgreementStatusChanged, agreementId, &common.AgreementStatusChanged{
+		AgreementId: agreementId,
+		To: serviceAgreementJson.Status,
+		UpdatedBy: lastUpdatedBy,
+	})
 	if err != nil {
 		return nil, err
 	}
 	fmt.Println("Service agreement created succcessfully.")
-	return nil, nil
+	return []byte(agreementId), nil
+}
+
+// ============================================================================================================================
+// sameAgreementTerms - whether a stored agreement was created with the terms of a request, i.e. a retry of that request
+// rather than another agreement reusing its idempotency key
+// ============================================================================================================================
+func sameAgreementTerms(stored common.Service_agreement, requested common.Service_agreement) bool {
+	if stored.CustomerId != requested.CustomerId || stored.ServiceProviderId != requested.ServiceProviderId ||
+		stored.Currency != requested.Currency || stored.StartDate != requested.StartDate || stored.EndDate != requested.EndDate ||
+		stored.DueAmount != requested.DueAmount || stored.InitialPaymentPercentage != requested.InitialPaymentPercentage ||
+		stored.PenaltyAmount != requested.PenaltyAmount || stored.PenaltyTimePeriod != requested.PenaltyTimePeriod ||
+		stored.PenaltyCap != requested.PenaltyCap || stored.CancellationFee != requested.CancellationFee ||
+		stored.ArbiterId != requested.ArbiterId || stored.AcceptanceWindow != requested.AcceptanceWindow ||
+		len(stored.Milestones) != len(requested.Milestones) {
+		return false
+	}
+	for i, milestone := range stored.Milestones {
+		other := requested.Milestones[i]
+		if milestone.MilestoneId != other.MilestoneId || milestone.Description != other.Description ||
+			milestone.Amount != other.Amount || milestone.Percentage != other.Percentage ||
+			milestone.DueDate != other.DueDate || milestone.AcceptanceCriteria != other.AcceptanceCriteria {
+			return false
+		}
+	}
+	return true
+}
+
+// statusUpdateRequest is the JSON argument of updateServiceAgreement
+type statusUpdateRequest struct{
+	AgreementId string `json:"agreementId"`
+	Status string `json:"status"` // the state to move the agreement to
 }
 
 // ============================================================================================================================
 // updateServiceAgreement - update Service Agreement into chaincode state
 // ============================================================================================================================
 func (t *ManageAgreement) updateServiceAgreement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var jsonResp string
+	request := statusUpdateRequest{}
+	err := common.DecodePayload(args, "status update", &request)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	if request.AgreementId == "" {
+		return common.Raise(stub, common.MissingField("agreementId"))
+	}
+	if request.Status == "" {
+		return common.Raise(stub, common.MissingField("status"))
+	}
+	return t.moveAgreement(stub, request.AgreementId, request.Status)
+}
+
+// ============================================================================================================================
+// moveAgreement - move an agreement to another state, performing the escrow and balance updates of the transition
+// ============================================================================================================================
+func (t *ManageAgreement) moveAgreement(stub shim.ChaincodeStubInterface, agreementId string, newStatus string) ([]byte, error) {
 	var err error
 	fmt.Println("updating a Service Agreement")
-	if len(args) != 5 {
-		errMsg := "{ \"message\" : \"Incorrect number of arguments. Expecting 5 arguments.\", \"code\" : \"503\"}"
-		err = stub.SetEvent("errEvent", []byte(errMsg))
-		if err != nil {
-			return nil, err
-		}
-		return nil, errors.New(errMsg)
+	counterparties, err := getCounterparties(stub)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	paymentChaincode := counterparties.PaymentChaincode
+	accountChaincode := counterparties.AccountChaincode
+	// the party moving the agreement is the transaction creator
+	lastUpdatedBy, err := common.CallerId(stub)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
 	}
-	// set attributes
-	agreementId := args[0]
-	lastUpdatedBy := args[1]
-	newStatus := args[2]
-	paymentChaincode := args[3]
-	accountChaincode := args[4]
 	// Fetch the service agreement details by agreementId
-	agreementAsBytes, err := stub.GetState(agreementId)
+	agreementAsBytes, err := getAgreementState(stub, agreementId)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + agreementId + "\"}"
-		return nil, errors.New(jsonResp)
+		return common.RaiseError(stub, common.CodeInternal, "Failed to get state for " + agreementId)
+	}
+	res := common.Service_agreement{}
+	err = common.DecodeState(agreementAsBytes, "Agreement " + agreementId, &res)
+	if err != nil {
+		return common.Raise(stub, err)
 	}
-	res := Service_agreement{}
-	json.Unmarshal(agreementAsBytes, &res)
 
 	if res.AgreementID == agreementId{
 		fmt.Println("Agreement found with agreementId : " + agreementId)
 		fmt.Println(res);
+		// only moves listed in the state machine, performed by an allowed party, are accepted
+		transition, err := findTransition(res.Status, newStatus)
+		if err != nil {
+			return common.Raise(stub, err)
+		}
+		if transition.Operation == "Dispute" || transition.Operation == "Resolve" {
+			return common.RaiseError(stub, common.CodeValidation, "Disputes are raised with raiseDispute and resolved with resolveDispute.")
+		}
+		party := partyOf(res, lastUpdatedBy)
+		if !transition.performableBy(party) {
+			return common.RejectUnauthorized(stub, lastUpdatedBy + " is not allowed to move the agreement to '" + newStatus + "'.")
+		}
 		res.LastUpdatedBy = lastUpdatedBy
-		res.LastUpdateDate = time.Now().Unix() // current unix timestamp
-		var paymentStatus string
-		// set Payment status according to agreement status
-		if res.Status == "Pending Customer Acceptance" && newStatus == "Pending start with Service Provider"{
-			paymentStatus = "Initial Payment"
-			// Customer account deducted and Service Provider account debited with initial payment
-			amountPaid := strconv.FormatFloat(res.DueAmount * res.InitialPaymentPercentage, 'f', 2, 64)
-			function := "updateAccountBalance"
-			invokeArgs1 := util.ToChaincodeArgs(function, res.CustomerId, res.ServiceProviderId, amountPaid, "Initial")
-			update_result, err1 := stub.InvokeChaincode(accountChaincode, invokeArgs1)
-			if err1 != nil {
-				errStr := fmt.Sprintf("Error in updating account balance from 'Account' chaincode. Got error: %s", err1.Error())
-				fmt.Printf(errStr)
-				return nil, errors.New(errStr)
-			}
-			fmt.Println("transaction Hash: ")
-			fmt.Println(update_result);
-			fmt.Println("Account Balances updated successfully.");
-			fmt.Println(res.AgreementID);
-			fmt.Println(agreementId);
-			// create Payment transaction
-			_function := "createPayment"
-			invokeArgs2 := util.ToChaincodeArgs(_function, res.AgreementID, paymentStatus, res.CustomerId, res.ServiceProviderId, amountPaid, lastUpdatedBy)
-			result, err2 := stub.InvokeChaincode(paymentChaincode, invokeArgs2)
-			if err2 != nil {
-				errStr := fmt.Sprintf("Error in fetching Payment details from 'Payment' chaincode. Got error: %s", err2.Error())
-				fmt.Printf(errStr)
-				return nil, errors.New(errStr)
-			}
-			fmt.Println("transaction Hash: ")
-			fmt.Println(result);
-			fmt.Println("Payment Created successfully.");
-		}else if newStatus == "Work in Progress" {
-			// no penalty applied
-			// do nothing, just update the agreement status
-		} else if newStatus == "Work Completed" {
-			paymentStatus = "Final Payment"
-			//	Customer account deducted with final payment (total amount – initial payment)
-			//	Service Provider account credited with final payment
-			amountPaid := strconv.FormatFloat(res.DueAmount -(res.DueAmount * res.InitialPaymentPercentage), 'f', 2, 64)
-			function := "updateAccountBalance"
-			invokeArgs1 := util.ToChaincodeArgs(function, res.CustomerId, res.ServiceProviderId, amountPaid, "Final")
-			update_result, err1 := stub.InvokeChaincode(accountChaincode, invokeArgs1)
-			if err1 != nil {
-				errStr := fmt.Sprintf("Error in updating account balance from 'Account' chaincode. Got error: %s", err1.Error())
-				fmt.Printf(errStr)
-				return nil, errors.New(errStr)
-			}
-			fmt.Println("transaction Hash: ")
-			fmt.Println(update_result);
-			fmt.Println("Account Balances updated successfully.");
-			// create Payment transaction
-			_function := "createPayment"
-			invokeArgs2 := util.ToChaincodeArgs(_function, res.AgreementID, paymentStatus, res.CustomerId, res.ServiceProviderId, amountPaid, lastUpdatedBy)
-			result, err2 := stub.InvokeChaincode(paymentChaincode, invokeArgs2)
-			if err2 != nil {
-				errStr := fmt.Sprintf("Error in fetching Payment details from 'Payment' chaincode. Got error: %s", err2.Error())
-				fmt.Printf(errStr)
-				return nil, errors.New(errStr)
+		res.LastUpdateDate, err = common.TxTimestamp(stub) // transaction timestamp
+		if err != nil {
+			return nil, err
+		}
+		err = checkTransitionRules(res, transition, party, res.LastUpdateDate)
+		if err != nil {
+			return common.Raise(stub, err)
+		}
+		// side effects of the transition: the escrow and balance updates and the Payments they trigger
+		err = applyTransition(stub, &res, transition, party, paymentChaincode, accountChaincode)
+		if err != nil {
+			return nil, err
+		}
+		if newStatus == common.StatusPendingStart {
+			// penalty periods for a late start count from now
+			res.PenaltyStartDate = res.LastUpdateDate
+		}
+		if newStatus == common.StatusWorkSubmitted {
+			// the Customer inspects the work until the auto-accept deadline, after which the Service Provider can claim payment
+			if res.AcceptanceWindow <= 0 {
+				res.AcceptanceWindow = DefaultAcceptanceWindow	// agreements created before acceptance windows existed
 			}
-			fmt.Println("transaction Hash: ")
-			fmt.Println(result);
-			fmt.Println("Payment Created successfully.");
+			res.WorkSubmittedDate = res.LastUpdateDate
+			res.AutoAcceptDate = res.LastUpdateDate + res.AcceptanceWindow
 		}
 		//build the Service Agreement json
-		serviceAgreementJson := &Service_agreement{res.AgreementID, newStatus, res.CustomerId, res.ServiceProviderId, res.StartDate, res.EndDate, res.DueAmount, res.InitialPaymentPercentage, res.PenaltyAmount, res.PenaltyTimePeriod, res.LastUpdatedBy, res.LastUpdateDate}
+		previousStatus := res.Status
+		res.Status = newStatus
+		serviceAgreementJson := &res
 
 		// convert *Service_agreement to []byte
 		serviceAgreementJsonasBytes, err := json.Marshal(serviceAgreementJson)
@@ -383,120 +566,370 @@ func (t *ManageAgreement) updateServiceAgreement(stub shim.ChaincodeStubInterfac
 			return nil, err
 		}
 		//store Agreement id as key
-		err = stub.PutState(res.AgreementID, serviceAgreementJsonasBytes)
+		err = putAgreementState(stub, res.AgreementID, serviceAgreementJsonasBytes)
 		if err != nil {
 			return nil, err
 		}
-		tosend := "{ \"Service Agreement ID\" : \""+res.AgreementID+"\", \"message\" : \"Service Agreement updated succcessfully\", \"code\" : \"200\"}"
-		err = stub.SetEvent("evtsender", []byte(tosend))
+		err = common.EmitEvent(stub, common.EventAgreementStatusChanged, res.AgreementID, &common.AgreementStatusChanged{
+			AgreementId: res.AgreementID,
+			From: previousStatus,
+			To: newStatus,
+			UpdatedBy: lastUpdatedBy,
+		})
 		if err != nil {
 			return nil, err
 		}
 	}else{
-		errMsg := "{ \"message\" : \""+ agreementId+ " Not Found.\", \"code\" : \"503\"}"
-		err = stub.SetEvent("errEvent", []byte(errMsg))
-		if err != nil {
-			return nil, err
-		}
-		return nil, nil
+		return common.RaiseError(stub, common.CodeNotFound, agreementId + " Not Found.")
 	}
 	fmt.Println("updated Service Agreement")
 	return nil, nil
 }
 
+// agreementIdRequest is the JSON argument of the functions that only name an agreement: rejectServiceAgreement,
+// cancelServiceAgreement and checkPenalty
+type agreementIdRequest struct{
+	AgreementId string `json:"agreementId"`
+}
+
+// ============================================================================================================================
+// decodeAgreementId - the agreementId of an agreementIdRequest payload
+// ============================================================================================================================
+func decodeAgreementId(args []string, name string) (string, error) {
+	request := agreementIdRequest{}
+	err := common.DecodePayload(args, name, &request)
+	if err != nil {
+		return "", err
+	}
+	return request.AgreementId, common.RequireField("agreementId", request.AgreementId)
+}
+
+// ============================================================================================================================
+// rejectServiceAgreement - the Customer turns down an agreement that is pending its acceptance
+// ============================================================================================================================
+func (t *ManageAgreement) rejectServiceAgreement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	agreementId, err := decodeAgreementId(args, "rejection")
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	return t.moveAgreement(stub, agreementId, common.StatusRejected)
+}
+
+// ============================================================================================================================
+// cancelServiceAgreement - either party cancels an agreement after the initial payment, refunding the Customer
+// ============================================================================================================================
+func (t *ManageAgreement) cancelServiceAgreement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	agreementId, err := decodeAgreementId(args, "cancellation")
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	return t.moveAgreement(stub, agreementId, common.StatusCancelled)
+}
+
 // ============================================================================================================================
-// CheckPenalty - update Service Agreement into chaincode state
+// checkPenalty - charge the Service Provider one PenaltyAmount for every uncharged PenaltyTimePeriod of a late start
 // ============================================================================================================================
 func (t *ManageAgreement) checkPenalty(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var jsonResp string
 	var err error
 	fmt.Println("Penalty Check Started.")
-	if len(args) != 4 {
-		errMsg := "{ \"message\" : \"Incorrect number of arguments. Expecting 4 arguments.\", \"code\" : \"503\"}"
-		err = stub.SetEvent("errEvent", []byte(errMsg))
-		if err != nil {
-			return nil, err
-		}
-		return nil, errors.New(errMsg)
+	agreementId, err := decodeAgreementId(args, "penalty check")
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	counterparties, err := getCounterparties(stub)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	paymentChaincode := counterparties.PaymentChaincode
+	accountChaincode := counterparties.AccountChaincode
+	lastUpdatedBy, err := common.CallerId(stub)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
 	}
-	// set attributes
-	agreementId := args[0]
-	lastUpdatedBy := args[1]
-	paymentChaincode := args[2]
-	accountChaincode := args[3]
 
 	// Fetch the service agreement details by agreementId
-	agreementAsBytes, err := stub.GetState(agreementId)
+	agreementAsBytes, err := getAgreementState(stub, agreementId)
+	if err != nil {
+		return common.RaiseError(stub, common.CodeInternal, "Failed to get state for " + agreementId)
+	}
+	res := common.Service_agreement{}
+	err = common.DecodeState(agreementAsBytes, "Agreement " + agreementId, &res)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + agreementId + "\"}"
-		return nil, errors.New(jsonResp)
+		return common.Raise(stub, err)
 	}
-	res := Service_agreement{}
-	json.Unmarshal(agreementAsBytes, &res)
 
 	if res.AgreementID == agreementId{
 		fmt.Println("Agreement found with agreementId : " + agreementId)
 		fmt.Println(res);
-		/*currentTime := time.Now().Unix()
-		fmt.Println(currentTime);
-		fmt.Println(res.LastUpdateDate);
-		fmt.Println(currentTime - res.LastUpdateDate);*/
-		if res.Status == "Pending start with Service Provider" /*&& res.PenaltyTimePeriod < currentTime - res.LastUpdateDate*/{
+		currentTime, err := common.TxTimestamp(stub)
+		if err != nil {
+			return nil, err
+		}
+		penalty, periods := duePenalty(res, currentTime)
+		fmt.Println("Penalty due: " + penalty.String() + " for periods ", periods)
+		if res.Status == common.StatusPendingStart && penalty.IsPositive() {
 			//	Service Provider account deducted with penalty amount
-			amountPaid := res.PenaltyAmount
-			paymentStatus := "Penalty Payment"
-			function := "updateAccountBalance"
-			invokeArgs := util.ToChaincodeArgs(function, res.CustomerId, res.ServiceProviderId, strconv.FormatFloat(res.PenaltyAmount,'f', 2, 64),"Penalty")
-			update_result, err := stub.InvokeChaincode(accountChaincode, invokeArgs)
+			_, err = payAndRecord(stub, accountChaincode, paymentChaincode, res, common.OperationPenalty, common.PaymentPenalty, penalty, "")
 			if err != nil {
-				errStr := fmt.Sprintf("Error in updating account balance from 'Account' chaincode. Got error: %s", err.Error())
-				fmt.Printf(errStr)
-				return nil, errors.New(errStr)
-			}
-			fmt.Println("transaction Hash: ",update_result);
-			fmt.Println("Account Balances updated successfully.");
-			// create Payment transaction
-			_function := "createPayment"
-			invokeArgs1 := util.ToChaincodeArgs(_function, res.AgreementID, paymentStatus, res.CustomerId, res.ServiceProviderId,  strconv.FormatFloat(amountPaid,'f', 2, 64), lastUpdatedBy)
-			result, err1 := stub.InvokeChaincode(paymentChaincode, invokeArgs1)
-			if err1 != nil {
-				errStr := fmt.Sprintf("Error in fetching Payment details from 'Payment' chaincode. Got error: %s", err1.Error())
-				fmt.Printf(errStr)
-				return nil, errors.New(errStr)
+				return nil, err
 			}
-			fmt.Println("transaction Hash: ", result);
 			fmt.Println("Penalty Payment Created successfully.");
-			tosend := "{ \"Service Agreement Id\" : \""+agreementId+"\", \"message\" : \"Penalty Applied to the agreement.\", \"code\" : \"200\"}"
-			err = stub.SetEvent("evtsender", []byte(tosend))
+			// remember the charged periods so that they are never charged again
+			res.PenalizedPeriods = append(res.PenalizedPeriods, periods...)
+			res.PenaltyCharged, err = res.PenaltyCharged.Add(penalty)
 			if err != nil {
 				return nil, err
 			}
-			fmt.Println(tosend);
-		}else{
-			tosend := "{ \"Service Agreement Id\" : \""+agreementId+"\", \"message\" : \"Penalty cannot be applied to the agreement.\", \"code\" : \"200\"}"
-			err = stub.SetEvent("evtsender", []byte(tosend))
+			res.LastUpdatedBy = lastUpdatedBy
+			res.LastUpdateDate = currentTime
+			serviceAgreementJsonasBytes, err := json.Marshal(res)
+			if err != nil {
+				return nil, err
+			}
+			err = putAgreementState(stub, res.AgreementID, serviceAgreementJsonasBytes)
 			if err != nil {
 				return nil, err
 			}
-			fmt.Println(tosend);
+			err = common.EmitEvent(stub, common.EventPenaltyApplied, agreementId, &common.PenaltyApplied{
+				AgreementId: agreementId,
+				Amount: penalty,
+				Periods: periods,
+				PenaltyCharged: res.PenaltyCharged,
+			})
+			if err != nil {
+				return nil, err
+			}
+			fmt.Println("Penalty Applied to the agreement " + agreementId)
+		}else{
+			// nothing changed, so there is no event
+			fmt.Println("Penalty cannot be applied to the agreement " + agreementId)
 		}
 	}else{
-		errMsg := "{ \"message\" : \""+ agreementId+ " Not Found.\", \"code\" : \"503\"}"
-		err = stub.SetEvent("errEvent", []byte(errMsg))
-		if err != nil {
-			return nil, err
-		}
-		return nil, nil
+		return common.RaiseError(stub, common.CodeNotFound, agreementId + " Not Found.")
 	}
 	fmt.Println("Penalty Check Completed.");
 	return nil, nil
 }
+// ============================================================================================================================
+// duePenalty - the penalty accrued and not yet charged at currentTime, and the periods it covers. One PenaltyAmount accrues
+// for every full PenaltyTimePeriod elapsed since PenaltyStartDate, until the PenaltyCap (if any) is reached.
+// ============================================================================================================================
+func duePenalty(res common.Service_agreement, currentTime int64) (common.Money, []int64) {
+	penalty := common.Money{Currency: res.PenaltyAmount.Currency}
+	periods := []int64{}
+	if res.PenaltyTimePeriod <= 0 || !res.PenaltyAmount.IsPositive() {
+		return penalty, periods
+	}
+	startDate := res.PenaltyStartDate
+	if startDate == 0 {
+		startDate = res.LastUpdateDate		// agreements created before PenaltyStartDate was recorded
+	}
+	charged := make(map[int64]bool)
+	for _, period := range res.PenalizedPeriods {
+		charged[period] = true
+	}
+	capped := res.PenaltyCap.IsPositive()
+	remaining := res.PenaltyCap.Amount - res.PenaltyCharged.Amount
+	elapsedPeriods := (currentTime - startDate) / res.PenaltyTimePeriod
+	for period := int64(1); period <= elapsedPeriods; period++ {
+		if charged[period] {
+			continue
+		}
+		amount := res.PenaltyAmount.Amount
+		if capped {
+			if remaining <= 0 {
+				break
+			}
+			if amount > remaining {
+				amount = remaining
+			}
+			remaining = remaining - amount
+		}
+		penalty.Amount = penalty.Amount + amount
+		periods = append(periods, period)
+	}
+	return penalty, periods
+}
+
+// ============================================================================================================================
+// loadAgreement - fetch an agreement from chaincode state
+// ============================================================================================================================
+func loadAgreement(stub shim.ChaincodeStubInterface, agreementId string) (common.Service_agreement, error) {
+	res := common.Service_agreement{}
+	agreementAsBytes, err := getAgreementState(stub, agreementId)
+	if err != nil {
+		return res, errors.New("Failed to get state for " + agreementId)
+	}
+	err = common.DecodeState(agreementAsBytes, "Agreement " + agreementId, &res)
+	if err != nil {
+		return res, err
+	}
+	if len(agreementAsBytes) == 0 || res.AgreementID != agreementId {
+		return res, common.NewError(common.CodeNotFound, agreementId + " Not Found.")
+	}
+	return res, nil
+}
+
+// ============================================================================================================================
+// saveAgreement - store an agreement into chaincode state
+// ============================================================================================================================
+func saveAgreement(stub shim.ChaincodeStubInterface, res common.Service_agreement) error {
+	agreementAsBytes, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return putAgreementState(stub, res.AgreementID, agreementAsBytes)
+}
+
+// ============================================================================================================================
+// getAgreementState - fetch a stored agreement by its Id, empty when there is none
+// ============================================================================================================================
+func getAgreementState(stub shim.ChaincodeStubInterface, agreementId string) ([]byte, error) {
+	key, err := common.CreateCompositeKey(AgreementObjectType, agreementId)
+	if err != nil {
+		return nil, err
+	}
+	return stub.GetState(key)
+}
+
+// ============================================================================================================================
+// putAgreementState - store an agreement under its agreement~id composite key and keep it in its history
+// ============================================================================================================================
+func putAgreementState(stub shim.ChaincodeStubInterface, agreementId string, agreementAsBytes []byte) error {
+	key, err := common.CreateCompositeKey(AgreementObjectType, agreementId)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(key, agreementAsBytes)
+	if err != nil {
+		return err
+	}
+	return common.RecordHistory(stub, AgreementObjectType, agreementId, agreementAsBytes)
+}
+
+// ============================================================================================================================
+// indexAgreementParties - index an agreement under its Customer and its Service Provider, which never change once it is
+// created
+// ============================================================================================================================
+func indexAgreementParties(stub shim.ChaincodeStubInterface, res common.Service_agreement) error {
+	for _, partyId := range []string{res.CustomerId, res.ServiceProviderId} {
+		key, err := common.CreateCompositeKey(PartyAgreementIndex, partyId, res.AgreementID)
+		if err != nil {
+			return err
+		}
+		err = stub.PutState(key, []byte{0x00})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// optionalArg - the i-th argument, or an empty string when the caller left it out
+// ============================================================================================================================
+func optionalArg(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+}
+
+// ============================================================================================================================
+// payAndRecord - move amountPaid between the agreement parties through the 'Account' chaincode and record it as a Payment,
+// returning the Id of the Payment
+// ============================================================================================================================
+func payAndRecord(stub shim.ChaincodeStubInterface, accountChaincode string, paymentChaincode string, res common.Service_agreement, operation string, paymentType string, amountPaid common.Money, relatedPaymentId string) (string, error) {
+	settlement, err := invokeAccount(stub, accountChaincode, common.UpdateBalanceRequest{
+		CustomerId: res.CustomerId,
+		ServiceProviderId: res.ServiceProviderId,
+		Amount: amountPaid,
+		Operation: operation,
+	})
+	if err != nil {
+		return "", err
+	}
+	return recordPayment(stub, paymentChaincode, res, paymentType, settlement, relatedPaymentId)
+}
+
+// ============================================================================================================================
+// invokeAccount - call a balance or escrow function of the 'Account' chaincode, returning the Settlement it made
+// ============================================================================================================================
+func invokeAccount(stub shim.ChaincodeStubInterface, accountChaincode string, request common.ChaincodeRequest) (common.Settlement, error) {
+	settlement := common.Settlement{}
+	update_result, err := stub.InvokeChaincode(accountChaincode, common.InvokeArgs(request))
+	if err != nil {
+		return settlement, surfaceChaincodeError(stub, accountChaincode, request.Function(), err)
+	}
+	err = json.Unmarshal(update_result, &settlement)
+	if err != nil {
+		return settlement, common.NewError(common.CodeChaincodeCall, "Unexpected response from 'Account' chaincode: " + string(update_result))
+	}
+	fmt.Println("Account Balances updated successfully. Journal: " + settlement.JournalId)
+	return settlement, nil
+}
+
+// ============================================================================================================================
+// recordPayment - record a settlement made by the 'Account' chaincode as a Payment, returning the Id of the Payment. The
+// called chaincodes set no events of their own, so the BalanceUpdated and PaymentCreated events are emitted here.
+// ============================================================================================================================
+func recordPayment(stub shim.ChaincodeStubInterface, paymentChaincode string, res common.Service_agreement, paymentType string, settlement common.Settlement, relatedPaymentId string) (string, error) {
+	// create Payment transaction, recording the FX rate used when the payer's account currency differs from the agreement's.
+	// The idempotency key names the transfer the Payment records: its journal is unique to the transaction and, within it,
+	// to the transfer, so a repeated createPayment for the same transfer resolves to the same Payment.
+	request := common.CreatePaymentRequest{
+		AgreementId: res.AgreementID,
+		PaymentType: paymentType,
+		CustomerAccount: res.CustomerId,
+		ReceiverAccount: res.ServiceProviderId,
+		AmountPaid: settlement.Amount,
+		PayerAmount: settlement.PayerAmount,
+		FxRate: settlement.FxRate,
+		IdempotencyKey: paymentType + "/" + settlement.JournalId,
+		RelatedPaymentId: relatedPaymentId,
+	}
+	result, err := stub.InvokeChaincode(paymentChaincode, common.InvokeArgs(request))
+	if err != nil {
+		return "", surfaceChaincodeError(stub, paymentChaincode, request.Function(), err)
+	}
+	fmt.Println(paymentType + " Created successfully: " + string(result))
+	paymentId := string(result)
+	err = common.EmitEvent(stub, common.EventBalanceUpdated, res.AgreementID, settlement.BalanceUpdated())
+	if err != nil {
+		return "", err
+	}
+	err = common.EmitEvent(stub, common.EventPaymentCreated, res.AgreementID, &common.PaymentCreated{
+		PaymentId: paymentId,
+		AgreementId: request.AgreementId,
+		PaymentType: request.PaymentType,
+		CustomerAccount: request.CustomerAccount,
+		ReceiverAccount: request.ReceiverAccount,
+		AmountPaid: request.AmountPaid,
+		PayerAmount: request.PayerAmount,
+		FxRate: request.FxRate,
+		RelatedPaymentId: request.RelatedPaymentId,
+	})
+	if err != nil {
+		return "", err
+	}
+	return paymentId, nil
+}
+
+// ============================================================================================================================
+// surfaceChaincodeError - relay a failed call to the 'Account' or 'Payment' chaincode, e.g. a balance update rejected for
+// insufficient funds, to the caller with the error of the called chaincode as its cause
+// ============================================================================================================================
+func surfaceChaincodeError(stub shim.ChaincodeStubInterface, chaincode string, function string, err error) error {
+	fmt.Println("Error in calling " + function + " of chaincode " + chaincode + ". Got error: " + err.Error())
+	_, err = common.Raise(stub, common.ChaincodeCallError(chaincode, function, err))
+	return err
+}
+
 // ============================================================================================================================
 //  getAll_ServiceAgreement- get details of all Service Agreement from chaincode state
 // ============================================================================================================================
 func (t *ManageAgreement) getAll_ServiceAgreement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var jsonResp, errResp string
-	var agreementIndex []string
+	var jsonResp string
 	fmt.Println("start getAll_ServiceAgreement")
 	var err error
 	// if len(args) != 1 {
@@ -508,32 +941,111 @@ func (t *ManageAgreement) getAll_ServiceAgreement(stub shim.ChaincodeStubInterfa
 	// 	return nil, nil
 	// }
 
-	// Fetch all the indexed Service agreements
-	agreementAsBytes, err := stub.GetState(ServiceAgreementIndexStr)
+	// admins see every agreement, everyone else only the agreements they are a party or the arbiter of
+	caller, err := common.GetIdentity(stub)
 	if err != nil {
-		return nil, errors.New("Failed to get Agreement index")
+		return common.RejectUnauthorized(stub, err.Error())
 	}
-	json.Unmarshal(agreementAsBytes, &agreementIndex)								//un stringify it aka JSON.parse()
-	fmt.Print("agreementIndex : ")
-	fmt.Println(agreementIndex)
+	// Fetch all the Service agreements by scanning their composite keys
 	jsonResp = "{"
-	for i,val := range agreementIndex{
-		fmt.Println(strconv.Itoa(i) + " - looking at " + val + " for all Agreement")
-		valueAsBytes, err := stub.GetState(val)
-		if err != nil {
-			errResp = "{\"Error\":\"Failed to get state for " + val + "\"}"
-			return nil, errors.New(errResp)
-		}
-		jsonResp = jsonResp + "\""+ val + "\":" + string(valueAsBytes[:])
-		if i < len(agreementIndex)-1 {
-			jsonResp = jsonResp + ","
+	separator := ""
+	count := 0
+	err = common.ScanPartialCompositeKey(stub, AgreementObjectType, []string{}, func(key string, attributes []string, valueAsBytes []byte) error {
+		val := attributes[0]
+		fmt.Println(strconv.Itoa(count) + " - looking at " + val + " for all Agreement")
+		count++
+		if !caller.HasRole(common.RoleAdmin) {
+			res := common.Service_agreement{}
+			err := common.DecodeState(valueAsBytes, "Agreement " + val, &res)
+			if err != nil {
+				return err
+			}
+			if partyOf(res, caller.OwnerId) == "" {
+				return nil
+			}
 		}
+		jsonResp = jsonResp + separator + "\""+ val + "\":" + string(valueAsBytes[:])
+		separator = ","
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	fmt.Println("len(agreementIndex) : ")
-	fmt.Println(len(agreementIndex))
+	fmt.Println("Agreements scanned : ")
+	fmt.Println(count)
 	jsonResp = jsonResp + "}"
 	fmt.Println("jsonResp : " + jsonResp)
 	fmt.Println("end get_AllAgreement")
 	//send it onward
 	return []byte(jsonResp), nil
 }
+
+// ============================================================================================================================
+// getServiceAgreementById - fetch a single agreement that the caller is a party or the arbiter of
+// ============================================================================================================================
+func (t *ManageAgreement) getServiceAgreementById(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return common.RaiseError(stub, common.CodeValidation, "Incorrect number of arguments. Expecting \"Agreement Id\" as an argument.")
+	}
+	agreementId := args[0]
+	agreementAsBytes, err := getAgreementState(stub, agreementId)
+	if err != nil {
+		return common.RaiseError(stub, common.CodeInternal, "Failed to get state for " + agreementId)
+	}
+	res := common.Service_agreement{}
+	err = common.DecodeState(agreementAsBytes, "Agreement " + agreementId, &res)
+	if err != nil {
+		return nil, err
+	}
+	if len(agreementAsBytes) == 0 || res.AgreementID != agreementId {
+		return common.RaiseError(stub, common.CodeNotFound, agreementId + " not Found.")
+	}
+	caller, err := common.GetIdentity(stub)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	if !caller.HasRole(common.RoleAdmin) && partyOf(res, caller.OwnerId) == "" {
+		return common.RejectUnauthorized(stub, caller.OwnerId + " is not a party of agreement " + agreementId + ".")
+	}
+	fmt.Println("Fetched agreement " + agreementId)
+	return agreementAsBytes, nil
+}
+
+// ============================================================================================================================
+// getAgreementsByParty - fetch every agreement a user is the Customer or the Service Provider of, through the party~id
+// index. Users other than admins can only ask for their own agreements.
+// ============================================================================================================================
+func (t *ManageAgreement) getAgreementsByParty(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return common.RaiseError(stub, common.CodeValidation, "Incorrect number of arguments. Expecting \"User Id\" as an argument.")
+	}
+	partyId := args[0]
+	caller, err := common.GetIdentity(stub)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	if !caller.HasRole(common.RoleAdmin) && caller.OwnerId != partyId {
+		return common.RejectUnauthorized(stub, caller.OwnerId + " can only look up its own agreements.")
+	}
+	agreementIds := []string{}
+	err = common.ScanPartialCompositeKey(stub, PartyAgreementIndex, []string{partyId}, func(key string, attributes []string, valueAsBytes []byte) error {
+		agreementIds = append(agreementIds, attributes[1])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	agreements := []json.RawMessage{}
+	for _, agreementId := range agreementIds {
+		agreementAsBytes, err := getAgreementState(stub, agreementId)
+		if err != nil {
+			return common.RaiseError(stub, common.CodeInternal, "Failed to get state for " + agreementId)
+		}
+		if len(agreementAsBytes) == 0 {
+			continue					//the index entry outlived its agreement, rebuildIndexes drops it
+		}
+		agreements = append(agreements, agreementAsBytes)
+	}
+	fmt.Println("Fetched " + strconv.Itoa(len(agreements)) + " agreements of " + partyId)
+	return json.Marshal(agreements)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+"fmt"
+"encoding/json"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+// milestoneRequest is how a milestone is given to createServiceAgreement: with either an amount or a percentage
+type milestoneRequest struct{
+	MilestoneId string `json:"milestoneId"`
+	Description string `json:"description"`
+	Amount string `json:"amount"` // decimal amount in the agreement currency
+	Percentage string `json:"percentage"` // percentage of DueAmount
+	DueDate int64 `json:"dueDate"` // unix seconds, between the agreement's startDate and endDate
+	AcceptanceCriteria string `json:"acceptanceCriteria"`
+}
+
+// ============================================================================================================================
+// parseMilestones - build the ordered payment schedule of an agreement from its JSON form and check that it adds up to the
+// DueAmount. Percentage milestones are rounded cumulatively, so that percentages adding up to 100 always add up to the
+// DueAmount exactly: each one gets round(DueAmount * percentages so far) - round(DueAmount * percentages before it).
+// Every milestone falls due within the agreement's dates, and no earlier than the milestone listed before it.
+// ============================================================================================================================
+func parseMilestones(requests []milestoneRequest, dueAmount common.Money, startDate int64, endDate int64) ([]common.Milestone, error) {
+	var err error
+	milestones := []common.Milestone{}
+	seen := make(map[string]bool)
+	total := common.Money{Currency: dueAmount.Currency}
+	var percentageSoFar common.Percentage
+	for i, request := range requests {
+		if request.MilestoneId == "" {
+			return nil, common.NewError(common.CodeValidation, "Milestone " + fmt.Sprint(i + 1) + " has no milestoneId.")
+		}
+		if seen[request.MilestoneId] {
+			return nil, common.NewError(common.CodeValidation, "Milestone " + request.MilestoneId + " is listed twice.")
+		}
+		seen[request.MilestoneId] = true
+		if request.DueDate < startDate || request.DueDate > endDate {
+			return nil, common.NewError(common.CodeValidation, "Milestone " + request.MilestoneId + " dueDate must be between startDate and endDate.")
+		}
+		if i > 0 && request.DueDate < requests[i - 1].DueDate {
+			return nil, common.NewError(common.CodeValidation, "Milestone " + request.MilestoneId + " is due before " + requests[i - 1].MilestoneId + ", which is listed first.")
+		}
+		milestone := common.Milestone{
+			MilestoneId: request.MilestoneId,
+			Description: request.Description,
+			DueDate: request.DueDate,
+			AcceptanceCriteria: request.AcceptanceCriteria,
+			Status: common.MilestonePending,
+		}
+		if (request.Amount == "") == (request.Percentage == "") {
+			return nil, common.NewError(common.CodeValidation, "Milestone " + request.MilestoneId + " needs either an amount or a percentage.")
+		}
+		if request.Amount != "" {
+			milestone.Amount, err = common.ParseAmount(request.Amount, dueAmount.Currency)
+			if err != nil {
+				return nil, common.FieldError("Milestone " + request.MilestoneId + " amount", err)
+			}
+		}else {
+			milestone.Percentage, err = common.ParsePercentage(request.Percentage)
+			if err != nil {
+				return nil, common.FieldError("Milestone " + request.MilestoneId + " percentage", err)
+			}
+			before := dueAmount.Percent(percentageSoFar)
+			percentageSoFar = percentageSoFar + milestone.Percentage
+			milestone.Amount = common.Money{Amount: dueAmount.Percent(percentageSoFar).Amount - before.Amount, Currency: dueAmount.Currency}
+		}
+		if !milestone.Amount.IsPositive() {
+			return nil, common.NewError(common.CodeValidation, "Milestone " + request.MilestoneId + " must have a positive amount.")
+		}
+		total.Amount = total.Amount + milestone.Amount.Amount
+		milestones = append(milestones, milestone)
+	}
+	if total.Amount != dueAmount.Amount {
+		return nil, common.NewError(common.CodeValidation, "Milestones add up to " + total.String() + " but the Due Amount is " + dueAmount.String() + ".")
+	}
+	return milestones, nil
+}
+
+// ============================================================================================================================
+// findMilestone - index of a milestone in the agreement's schedule
+// ============================================================================================================================
+func findMilestone(res common.Service_agreement, milestoneId string) (int, error) {
+	for i, milestone := range res.Milestones {
+		if milestone.MilestoneId == milestoneId {
+			return i, nil
+		}
+	}
+	return -1, common.NewError(common.CodeNotFound, "Milestone " + milestoneId + " not found in agreement " + res.AgreementID + ".")
+}
+
+// ============================================================================================================================
+// acceptedMilestonesTotal - what has been paid for accepted milestones
+// ============================================================================================================================
+func acceptedMilestonesTotal(res common.Service_agreement) common.Money {
+	total := common.Money{Currency: res.DueAmount.Currency}
+	for _, milestone := range res.Milestones {
+		if milestone.Status == common.MilestoneAccepted {
+			total.Amount = total.Amount + milestone.Amount.Amount
+		}
+	}
+	return total
+}
+
+// ============================================================================================================================
+// allMilestonesAccepted - whether every milestone of the agreement has been accepted by the Customer
+// ============================================================================================================================
+func allMilestonesAccepted(res common.Service_agreement) bool {
+	for _, milestone := range res.Milestones {
+		if milestone.Status != common.MilestoneAccepted {
+			return false
+		}
+	}
+	return true
+}
+
+// milestoneUpdateRequest is the JSON argument of completeMilestone and acceptMilestone
+type milestoneUpdateRequest struct{
+	AgreementId string `json:"agreementId"`
+	MilestoneId string `json:"milestoneId"`
+}
+
+// ============================================================================================================================
+// decodeMilestoneUpdate - decode and check a milestoneUpdateRequest
+// ============================================================================================================================
+func decodeMilestoneUpdate(args []string) (milestoneUpdateRequest, error) {
+	request := milestoneUpdateRequest{}
+	err := common.DecodePayload(args, "milestone update", &request)
+	if err != nil {
+		return request, err
+	}
+	err = common.RequireField("agreementId", request.AgreementId)
+	if err != nil {
+		return request, err
+	}
+	return request, common.RequireField("milestoneId", request.MilestoneId)
+}
+
+// ============================================================================================================================
+// completeMilestone - the Service Provider reports a milestone as done, so that the Customer can accept it
+// ============================================================================================================================
+func (t *ManageAgreement) completeMilestone(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	request, err := decodeMilestoneUpdate(args)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	return t.updateMilestone(stub, request.AgreementId, request.MilestoneId, common.MilestonePending, common.MilestoneCompleted, PartyServiceProvider)
+}
+
+// ============================================================================================================================
+// acceptMilestone - the Customer accepts a completed milestone, which pays its amount to the Service Provider
+// ============================================================================================================================
+func (t *ManageAgreement) acceptMilestone(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	request, err := decodeMilestoneUpdate(args)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	return t.updateMilestone(stub, request.AgreementId, request.MilestoneId, common.MilestoneCompleted, common.MilestoneAccepted, PartyCustomer)
+}
+
+// ============================================================================================================================
+// updateMilestone - move a milestone of an agreement that is in progress from one state to the next
+// ============================================================================================================================
+func (t *ManageAgreement) updateMilestone(stub shim.ChaincodeStubInterface, agreementId string, milestoneId string, from string, to string, performedBy string) ([]byte, error) {
+	lastUpdatedBy, err := common.CallerId(stub)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	agreementAsBytes, err := getAgreementState(stub, agreementId)
+	if err != nil {
+		return common.RaiseError(stub, common.CodeInternal, "Failed to get state for " + agreementId)
+	}
+	res := common.Service_agreement{}
+	err = common.DecodeState(agreementAsBytes, "Agreement " + agreementId, &res)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	if len(agreementAsBytes) == 0 || res.AgreementID != agreementId {
+		return common.RaiseError(stub, common.CodeNotFound, agreementId + " Not Found.")
+	}
+	if res.Status != common.StatusWorkInProgress {
+		return common.RaiseError(stub, common.CodeConflict, "Milestones can only be updated while the agreement is '" + common.StatusWorkInProgress + "'.")
+	}
+	if partyOf(res, lastUpdatedBy) != performedBy {
+		return common.RejectUnauthorized(stub, "Only the " + performedBy + " can move a milestone to '" + to + "'.")
+	}
+	i, err := findMilestone(res, milestoneId)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	if res.Milestones[i].Status != from {
+		return common.RaiseError(stub, common.CodeConflict, "Milestone " + milestoneId + " is '" + res.Milestones[i].Status + "', it cannot move to '" + to + "'.")
+	}
+	currentTime, err := common.TxTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	if to == common.MilestoneAccepted {
+		counterparties, err := getCounterparties(stub)
+		if err != nil {
+			return common.Raise(stub, err)
+		}
+		paymentId, err := payAndRecord(stub, counterparties.AccountChaincode, counterparties.PaymentChaincode, res, common.OperationMilestone, common.PaymentMilestone, res.Milestones[i].Amount, "")
+		if err != nil {
+			return nil, err
+		}
+		res.Milestones[i].PaymentId = paymentId
+		res.Milestones[i].AcceptedDate = currentTime
+		res.PaidAmount.Amount = res.PaidAmount.Amount + res.Milestones[i].Amount.Amount
+	}else {
+		res.Milestones[i].CompletedDate = currentTime
+	}
+	res.Milestones[i].Status = to
+	res.LastUpdatedBy = lastUpdatedBy
+	res.LastUpdateDate = currentTime
+	agreementAsBytes, err = json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	err = putAgreementState(stub, res.AgreementID, agreementAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	err = common.EmitEvent(stub, common.EventMilestoneStatusChanged, res.AgreementID, &common.MilestoneStatusChanged{
+		AgreementId: res.AgreementID,
+		MilestoneId: milestoneId,
+		From: from,
+		To: to,
+		UpdatedBy: lastUpdatedBy,
+		PaymentId: res.Milestones[i].PaymentId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Milestone " + milestoneId + " of " + agreementId + " moved to " + to)
+	return nil, nil
+}
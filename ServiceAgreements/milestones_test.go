@@ -0,0 +1,35 @@
+package main
+
+import (
+"testing"
+)
+
+func TestParseMilestonesChecksDueDates(t *testing.T) {
+	start, end := int64(1000), int64(2000)
+	cases := []struct{
+		name string
+		dueDates []int64
+		ok bool
+	}{
+		{"within the agreement, in order", []int64{1000, 1500, 2000}, true},
+		{"same day", []int64{1500, 1500}, true},
+		{"no due date", []int64{0, 1500}, false},
+		{"before startDate", []int64{999, 1500}, false},
+		{"after endDate", []int64{1500, 2001}, false},
+		{"out of order", []int64{1800, 1200}, false},
+	}
+	for _, c := range cases {
+		requests := []milestoneRequest{}
+		for i, dueDate := range c.dueDates {
+			requests = append(requests, milestoneRequest{MilestoneId: string(rune('A' + i)), Amount: "10.00", DueDate: dueDate})
+		}
+		dueAmount := usd(int64(1000 * len(c.dueDates)))
+		milestones, err := parseMilestones(requests, dueAmount, start, end)
+		if c.ok && (err != nil || len(milestones) != len(c.dueDates)) {
+			t.Errorf("%s: got %v, want the milestones accepted", c.name, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%s: milestones accepted, want them rejected", c.name)
+		}
+	}
+}
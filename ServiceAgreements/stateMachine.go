@@ -0,0 +1,264 @@
+package main
+
+import (
+"fmt"
+"encoding/json"
+"time"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+// Parties of an agreement that may perform a transition
+var PartyCustomer = "Customer"
+var PartyServiceProvider = "Service Provider"
+var PartyArbiter = "Arbiter"
+
+// Transition is an allowed move of an agreement from one state to another, the parties that may perform it and
+// the balance update it triggers, if any: "Hold" reserves the initial payment in escrow, "Final" releases it and pays the
+// rest of the DueAmount once the Customer accepts the work, "Refund" returns what is held or was paid to the Customer, less
+// the cancellation fee when the Customer cancels. "Dispute" and "Resolve" moves are only made by raiseDispute and
+// resolveDispute.
+type Transition struct{
+	From string `json:"from"`
+	To string `json:"to"`
+	PerformedBy []string `json:"performedBy"`
+	Operation string `json:"operation,omitempty"`
+	PaymentType string `json:"paymentType,omitempty"`
+}
+
+// transitions is the agreement state machine; any move not listed here is rejected
+var transitions = []Transition{
+	Transition{common.StatusPendingCustomerAcceptance, common.StatusPendingStart, []string{PartyCustomer}, common.OperationHold, common.PaymentEscrowHold},
+	Transition{common.StatusPendingStart, common.StatusWorkInProgress, []string{PartyServiceProvider}, "", ""},
+	Transition{common.StatusWorkInProgress, common.StatusWorkSubmitted, []string{PartyServiceProvider}, "", ""},
+	Transition{common.StatusWorkSubmitted, common.StatusWorkInProgress, []string{PartyCustomer}, "", ""},
+	Transition{common.StatusWorkSubmitted, common.StatusAccepted, []string{PartyCustomer, PartyServiceProvider}, common.OperationFinal, common.PaymentFinal},
+	Transition{common.StatusPendingCustomerAcceptance, common.StatusRejected, []string{PartyCustomer}, "", ""},
+	Transition{common.StatusPendingStart, common.StatusCancelled, []string{PartyCustomer, PartyServiceProvider}, common.OperationRefund, common.PaymentRefund},
+	Transition{common.StatusWorkInProgress, common.StatusCancelled, []string{PartyCustomer, PartyServiceProvider}, common.OperationRefund, common.PaymentRefund},
+	Transition{common.StatusPendingStart, common.StatusDisputed, []string{PartyCustomer, PartyServiceProvider}, "Dispute", ""},
+	Transition{common.StatusWorkInProgress, common.StatusDisputed, []string{PartyCustomer, PartyServiceProvider}, "Dispute", ""},
+	Transition{common.StatusWorkSubmitted, common.StatusDisputed, []string{PartyCustomer, PartyServiceProvider}, "Dispute", ""},
+	Transition{common.StatusDisputed, common.StatusAccepted, []string{PartyArbiter}, "Resolve", ""},
+	Transition{common.StatusDisputed, common.StatusCancelled, []string{PartyArbiter}, "Resolve", ""},
+	Transition{common.StatusDisputed, common.StatusPendingStart, []string{PartyArbiter}, "Resolve", ""},
+	Transition{common.StatusDisputed, common.StatusWorkInProgress, []string{PartyArbiter}, "Resolve", ""},
+	Transition{common.StatusDisputed, common.StatusWorkSubmitted, []string{PartyArbiter}, "Resolve", ""},
+}
+
+// DefaultAcceptanceWindow is how long, in seconds, the Customer has to inspect submitted work when the agreement sets none
+var DefaultAcceptanceWindow int64 = 7 * 24 * 60 * 60
+
+// ============================================================================================================================
+// findTransition - the transition from one state to another, or an error when the move is not allowed
+// ============================================================================================================================
+func findTransition(from string, to string) (Transition, error) {
+	for _, transition := range transitions {
+		if transition.From == from && transition.To == to {
+			return transition, nil
+		}
+	}
+	return Transition{}, common.NewError(common.CodeConflict, "An agreement in status '" + from + "' cannot move to '" + to + "'.")
+}
+
+// ============================================================================================================================
+// allowedTransitions - the transitions out of a state, limited to those the given party may perform unless party is empty
+// ============================================================================================================================
+func allowedTransitions(from string, party string) []Transition {
+	allowed := []Transition{}
+	for _, transition := range transitions {
+		if transition.From == from && (party == "" || transition.performableBy(party)) {
+			allowed = append(allowed, transition)
+		}
+	}
+	return allowed
+}
+
+func (transition Transition) performableBy(party string) bool {
+	for _, allowed := range transition.PerformedBy {
+		if allowed == party {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================================================================
+// partyOf - whether the user is the Customer, the Service Provider or the arbiter of the agreement, empty when none
+// ============================================================================================================================
+func partyOf(res common.Service_agreement, userId string) string {
+	if userId == res.CustomerId {
+		return PartyCustomer
+	}else if userId == res.ServiceProviderId {
+		return PartyServiceProvider
+	}else if userId != "" && userId == res.ArbiterId {
+		return PartyArbiter
+	}
+	return ""
+}
+
+// ============================================================================================================================
+// checkTransitionRules - the conditions a transition has beyond the parties that may perform it: submitted work needs every
+// milestone accepted, and the Service Provider can only accept its own work once the Customer's auto-accept deadline passed
+// ============================================================================================================================
+func checkTransitionRules(res common.Service_agreement, transition Transition, party string, currentTime int64) error {
+	if transition.To == common.StatusWorkSubmitted && !allMilestonesAccepted(res) {
+		return common.NewError(common.CodeConflict, "Every milestone must be accepted before the work is '" + common.StatusWorkSubmitted + "'.")
+	}
+	if transition.To == common.StatusAccepted && party == PartyServiceProvider && currentTime < res.AutoAcceptDate {
+		return common.NewError(common.CodeConflict, "The Customer has until " + time.Unix(res.AutoAcceptDate, 0).UTC().Format(time.RFC3339) + " to accept the work.")
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// applyTransition - perform the escrow and balance updates a transition triggers and record them as Payments
+// ============================================================================================================================
+func applyTransition(stub shim.ChaincodeStubInterface, res *common.Service_agreement, transition Transition, party string, paymentChaincode string, accountChaincode string) error {
+	if transition.Operation == common.OperationHold {
+		// the initial payment stays in escrow until the work is completed or the agreement is cancelled
+		initialPayment, _ := res.DueAmount.Split(res.InitialPaymentPercentage)
+		if !initialPayment.IsPositive() {
+			return nil
+		}
+		settlement, err := invokeAccount(stub, accountChaincode, common.HoldFundsRequest{
+			AgreementId: res.AgreementID,
+			CustomerId: res.CustomerId,
+			ServiceProviderId: res.ServiceProviderId,
+			Amount: initialPayment,
+		})
+		if err != nil {
+			return err
+		}
+		res.InitialPaymentId, err = recordPayment(stub, paymentChaincode, *res, transition.PaymentType, settlement, "")
+		if err != nil {
+			return err
+		}
+		res.HeldAmount = initialPayment
+		return nil
+	}
+	if transition.Operation == common.OperationFinal {
+		err := settleHeldAmount(stub, res, true, common.PaymentEscrowRelease, res.HeldAmount, paymentChaincode, accountChaincode)
+		if err != nil {
+			return err
+		}
+		// final payment is the total amount – what was already paid (initial payment or milestones)
+		finalPayment := common.Money{Amount: res.DueAmount.Amount - res.PaidAmount.Amount, Currency: res.DueAmount.Currency}
+		if !finalPayment.IsPositive() {
+			return nil
+		}
+		_, err = payAndRecord(stub, accountChaincode, paymentChaincode, *res, common.OperationFinal, transition.PaymentType, finalPayment, "")
+		if err != nil {
+			return err
+		}
+		res.PaidAmount.Amount = res.PaidAmount.Amount + finalPayment.Amount
+		return nil
+	}
+	if transition.Operation == common.OperationRefund {
+		// a Customer cancelling pays the cancellation fee, out of the held funds first
+		fee := common.Money{Currency: res.DueAmount.Currency}
+		if party == PartyCustomer {
+			fee = res.CancellationFee
+		}
+		feeFromHold := fee
+		if feeFromHold.Amount > res.HeldAmount.Amount {
+			feeFromHold.Amount = res.HeldAmount.Amount
+		}
+		err := settleHeldAmount(stub, res, true, common.PaymentCancellationFee, feeFromHold, paymentChaincode, accountChaincode)
+		if err != nil {
+			return err
+		}
+		err = settleHeldAmount(stub, res, false, common.PaymentRefund, res.HeldAmount, paymentChaincode, accountChaincode)
+		if err != nil {
+			return err
+		}
+		// anything else paid to the Service Provider, other than for accepted milestones, is refunded; the fee is kept whether it
+		// came out of the held funds or not
+		kept := common.Money{Amount: res.PaidAmount.Amount - acceptedMilestonesTotal(*res).Amount, Currency: res.PaidAmount.Currency}
+		if kept.Amount < fee.Amount {
+			// the Service Provider holds less than the fee, so the Customer pays the rest of it from its account
+			shortfall := common.Money{Amount: fee.Amount - kept.Amount, Currency: fee.Currency}
+			_, err = payAndRecord(stub, accountChaincode, paymentChaincode, *res, common.OperationFinal, common.PaymentCancellationFee, shortfall, res.InitialPaymentId)
+			if err != nil {
+				return err
+			}
+			res.PaidAmount.Amount = res.PaidAmount.Amount + shortfall.Amount
+			return nil
+		}
+		refund := common.Money{Amount: kept.Amount - fee.Amount, Currency: kept.Currency}
+		if !refund.IsPositive() {
+			return nil
+		}
+		_, err = payAndRecord(stub, accountChaincode, paymentChaincode, *res, common.OperationRefund, transition.PaymentType, refund, res.InitialPaymentId)
+		if err != nil {
+			return err
+		}
+		res.PaidAmount.Amount = res.PaidAmount.Amount - refund.Amount
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// settleHeldAmount - release part of the agreement's escrow hold to the Service Provider, or return it to the Customer,
+// and record it as a Payment linked to the hold
+// ============================================================================================================================
+func settleHeldAmount(stub shim.ChaincodeStubInterface, res *common.Service_agreement, toServiceProvider bool, paymentType string, amount common.Money, paymentChaincode string, accountChaincode string) error {
+	if !amount.IsPositive() {
+		return nil
+	}
+	settlement, err := invokeAccount(stub, accountChaincode, common.SettleHoldRequest{AgreementId: res.AgreementID, Amount: amount, ToServiceProvider: toServiceProvider})
+	if err != nil {
+		return err
+	}
+	_, err = recordPayment(stub, paymentChaincode, *res, paymentType, settlement, res.InitialPaymentId)
+	if err != nil {
+		return err
+	}
+	res.HeldAmount.Amount = res.HeldAmount.Amount - amount.Amount
+	if toServiceProvider {
+		res.PaidAmount.Amount = res.PaidAmount.Amount + amount.Amount
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// getAllowedTransitions - query the next states an agreement can move to that the caller may perform. Admins see every
+// transition, or those of the user they ask about.
+// ============================================================================================================================
+func (t *ManageAgreement) getAllowedTransitions(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return common.RaiseError(stub, common.CodeValidation, "Incorrect number of arguments. Expecting Agreement Id and optionally a User Id.")
+	}
+	agreementId := args[0]
+	agreementAsBytes, err := getAgreementState(stub, agreementId)
+	if err != nil {
+		return common.RaiseError(stub, common.CodeInternal, "Failed to get state for " + agreementId)
+	}
+	res := common.Service_agreement{}
+	err = common.DecodeState(agreementAsBytes, "Agreement " + agreementId, &res)
+	if err != nil {
+		return nil, err
+	}
+	if len(agreementAsBytes) == 0 || res.AgreementID != agreementId {
+		return common.RaiseError(stub, common.CodeNotFound, agreementId+ " Not Found.")
+	}
+	caller, err := common.GetIdentity(stub)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	// only admins can look at the transitions of another user, or at all of them
+	userId := caller.OwnerId
+	if caller.HasRole(common.RoleAdmin) {
+		userId = optionalArg(args, 1)
+	}
+	party := ""
+	if userId != "" {
+		party = partyOf(res, userId)
+		if party == "" {
+			return json.Marshal(map[string]interface{}{"agreementId": agreementId, "status": res.Status, "transitions": []Transition{}})
+		}
+	}
+	fmt.Println("Allowed transitions from " + res.Status)
+	return json.Marshal(map[string]interface{}{"agreementId": agreementId, "status": res.Status, "transitions": allowedTransitions(res.Status, party)})
+}
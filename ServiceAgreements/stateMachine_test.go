@@ -0,0 +1,279 @@
+package main
+
+import (
+"encoding/json"
+"strconv"
+"strings"
+"testing"
+
+"github.com/golang/protobuf/ptypes/timestamp"
+"github.com/hyperledger/fabric/core/chaincode/shim"
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+// chaincodeCall is a call the agreement made to the 'Account' or 'Payment' chaincode
+type chaincodeCall struct{
+	chaincode string
+	function string
+	args []string
+}
+
+// fakeStub answers the calls applyTransition makes to the other chaincodes: balance and escrow functions settle the
+// amount they are given, createPayment answers with a new Payment Id. It has no state and keeps the event set on it;
+// any other stub function is not expected.
+type fakeStub struct{
+	shim.ChaincodeStubInterface
+	calls []chaincodeCall
+	eventName string
+	event []byte
+}
+
+func (stub *fakeStub) GetTxID() string {
+	return "tx1"
+}
+
+func (stub *fakeStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: 1500000000}, nil
+}
+
+func (stub *fakeStub) GetState(key string) ([]byte, error) {
+	return nil, nil
+}
+
+func (stub *fakeStub) SetEvent(name string, payload []byte) error {
+	stub.eventName, stub.event = name, payload
+	return nil
+}
+
+func (stub *fakeStub) InvokeChaincode(chaincodeName string, invokeArgs [][]byte) ([]byte, error) {
+	call := chaincodeCall{chaincode: chaincodeName, function: string(invokeArgs[0])}
+	for _, arg := range invokeArgs[1:] {
+		call.args = append(call.args, string(arg))
+	}
+	stub.calls = append(stub.calls, call)
+	if call.function == common.FunctionCreatePayment {
+		return []byte("PA" + strconv.Itoa(len(stub.calls))), nil
+	}
+	amount := common.Money{}
+	if len(call.args) > 0 {
+		amount, _ = common.ParseMoney(call.args[len(call.args) - 1])
+	}
+	if call.function == common.FunctionUpdateAccountBalance {
+		amount, _ = common.ParseMoney(call.args[2])
+	}
+	return json.Marshal(common.Settlement{JournalId: "JR" + strconv.Itoa(len(stub.calls)), Amount: amount, PayerAmount: amount})
+}
+
+// transfers - the balance and escrow calls made, as "function amount", in order
+func (stub *fakeStub) transfers() []string {
+	transfers := []string{}
+	for _, call := range stub.calls {
+		if call.function == common.FunctionUpdateAccountBalance {
+			transfers = append(transfers, call.args[3] + " " + call.args[2])
+		}else if call.function != common.FunctionCreatePayment {
+			transfers = append(transfers, call.function + " " + call.args[len(call.args) - 1])
+		}
+	}
+	return transfers
+}
+
+func usd(amount int64) common.Money {
+	return common.Money{Amount: amount, Currency: "USD"}
+}
+
+func legacyAgreement(t *testing.T, status string) common.Service_agreement {
+	res := common.Service_agreement{}
+	err := json.Unmarshal([]byte(`{"AgreementID":"SA1","Status":"` + status + `","CustomerId":"C1","ServiceProviderId":"S1","DueAmount":1000,"InitialPaymentPercentage":0.2,"PenaltyAmount":10}`), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestLegacyAgreementFinalPaysTheRest(t *testing.T) {
+	res := legacyAgreement(t, common.StatusWorkInProgress)
+	transition, _ := findTransition(common.StatusWorkSubmitted, common.StatusAccepted)
+	stub := &fakeStub{}
+	err := applyTransition(common.RecordEvents(stub), &res, transition, PartyCustomer, "payments", "accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the initial 200.00 was paid under the earlier flow, only the rest is due
+	transfers := stub.transfers()
+	if len(transfers) != 1 || transfers[0] != "Final 800.00 USD" {
+		t.Errorf("transfers = %v, want [Final 800.00 USD]", transfers)
+	}
+	if res.PaidAmount != usd(100000) || res.HeldAmount != usd(0) {
+		t.Errorf("paid %v and held %v, want 1000.00 USD paid and nothing held", res.PaidAmount, res.HeldAmount)
+	}
+}
+
+func TestLegacyAgreementCancelRefundsInitialPayment(t *testing.T) {
+	res := legacyAgreement(t, common.StatusPendingStart)
+	transition, _ := findTransition(common.StatusPendingStart, common.StatusCancelled)
+	stub := &fakeStub{}
+	err := applyTransition(common.RecordEvents(stub), &res, transition, PartyServiceProvider, "payments", "accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfers := stub.transfers()
+	if len(transfers) != 1 || transfers[0] != "Refund 200.00 USD" {
+		t.Errorf("transfers = %v, want [Refund 200.00 USD]", transfers)
+	}
+	if !res.PaidAmount.IsZero() {
+		t.Errorf("paid after refund = %v, want nothing", res.PaidAmount)
+	}
+}
+
+func TestLegacyAgreementBackfill(t *testing.T) {
+	var tests = []struct{
+		status string
+		paid int64
+	}{
+		{common.StatusPendingCustomerAcceptance, 0},
+		{common.StatusRejected, 0},
+		{common.StatusPendingStart, 20000},
+		{common.StatusWorkInProgress, 20000},
+		{common.StatusWorkCompleted, 100000},
+	}
+	for _, test := range tests {
+		res := legacyAgreement(t, test.status)
+		if res.PaidAmount != usd(test.paid) || res.HeldAmount != usd(0) {
+			t.Errorf("%s: paid %v and held %v, want %v paid and nothing held", test.status, res.PaidAmount, res.HeldAmount, usd(test.paid))
+		}
+	}
+}
+
+func TestTransitionEventsArePublishedTogether(t *testing.T) {
+	res := legacyAgreement(t, common.StatusWorkInProgress)
+	transition, _ := findTransition(common.StatusWorkSubmitted, common.StatusAccepted)
+	stub := &fakeStub{}
+	recorder := common.RecordEvents(stub)
+	err := applyTransition(recorder, &res, transition, PartyCustomer, "payments", "accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = recorder.Publish("updateServiceAgreement")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stub.eventName != common.EventTransactionCompleted {
+		t.Fatalf("event set = %q, want %s", stub.eventName, common.EventTransactionCompleted)
+	}
+	event := common.TransactionCompleted{}
+	err = json.Unmarshal(stub.event, &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventTypes := []string{}
+	for _, payload := range event.Events {
+		header := common.EventHeader{}
+		json.Unmarshal(payload, &header)
+		eventTypes = append(eventTypes, header.EventType)
+	}
+	if len(eventTypes) != 2 || eventTypes[0] != common.EventBalanceUpdated || eventTypes[1] != common.EventPaymentCreated {
+		t.Errorf("events = %v, want the BalanceUpdated and PaymentCreated of the final payment", eventTypes)
+	}
+}
+
+func TestPaymentsOfOneTransactionHaveTheirOwnIdempotencyKey(t *testing.T) {
+	// a cancellation returns the held funds and refunds what was paid, two Refund payments in one transaction
+	res := common.Service_agreement{AgreementID: "SA1", CustomerId: "C1", ServiceProviderId: "S1", DueAmount: usd(100000), HeldAmount: usd(20000), PaidAmount: usd(10000), InitialPaymentId: "PA0"}
+	transition, _ := findTransition(common.StatusWorkInProgress, common.StatusCancelled)
+	stub := &fakeStub{}
+	err := applyTransition(common.RecordEvents(stub), &res, transition, PartyServiceProvider, "payments", "accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, call := range stub.calls {
+		if call.function == common.FunctionCreatePayment {
+			keys = append(keys, call.args[7])
+		}
+	}
+	if len(keys) != 2 || keys[0] == "" || keys[0] == keys[1] {
+		t.Errorf("idempotency keys = %v, want two different keys", keys)
+	}
+}
+
+func TestCustomerCancellingPaysTheFeeTheHoldDoesNotCover(t *testing.T) {
+	cases := []struct{
+		name string
+		held int64
+		transfers []string
+	}{
+		{"nothing held", 0, []string{"Final 50.00 USD"}},
+		{"less held than the fee", 2000, []string{"releaseFunds 20.00 USD", "Final 30.00 USD"}},
+		{"more held than the fee", 8000, []string{"releaseFunds 50.00 USD", "returnFunds 30.00 USD"}},
+	}
+	for _, c := range cases {
+		res := common.Service_agreement{AgreementID: "SA1", Status: common.StatusPendingStart, CustomerId: "C1", ServiceProviderId: "S1",
+			DueAmount: usd(100000), CancellationFee: usd(5000), HeldAmount: usd(c.held), PaidAmount: usd(0)}
+		transition, _ := findTransition(common.StatusPendingStart, common.StatusCancelled)
+		stub := &fakeStub{}
+		err := applyTransition(common.RecordEvents(stub), &res, transition, PartyCustomer, "payments", "accounts")
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		transfers := stub.transfers()
+		if strings.Join(transfers, ", ") != strings.Join(c.transfers, ", ") {
+			t.Errorf("%s: transfers = %v, want %v", c.name, transfers, c.transfers)
+		}
+		if res.PaidAmount != usd(5000) || !res.HeldAmount.IsZero() {
+			t.Errorf("%s: paid %v and held %v, want the 50.00 USD fee paid and nothing held", c.name, res.PaidAmount, res.HeldAmount)
+		}
+	}
+}
+
+func TestApplyTransition(t *testing.T) {
+	cases := []struct{
+		name string
+		from string
+		to string
+		party string
+		percentage common.Percentage
+		held int64
+		paid int64
+		transfers []string
+		heldAfter int64
+		paidAfter int64
+	}{
+		{"hold the initial payment", common.StatusPendingCustomerAcceptance, common.StatusPendingStart, PartyCustomer, 2000, 0, 0,
+			[]string{"holdFunds 200.00 USD"}, 20000, 0},
+		{"nothing to hold", common.StatusPendingCustomerAcceptance, common.StatusPendingStart, PartyCustomer, 0, 0, 0,
+			[]string{}, 0, 0},
+		{"final releases the hold and pays the rest", common.StatusWorkSubmitted, common.StatusAccepted, PartyCustomer, 2000, 20000, 0,
+			[]string{"releaseFunds 200.00 USD", "Final 800.00 USD"}, 0, 100000},
+		{"final after everything was paid", common.StatusWorkSubmitted, common.StatusAccepted, PartyServiceProvider, 0, 0, 100000,
+			[]string{}, 0, 100000},
+		{"Service Provider cancelling returns the hold", common.StatusPendingStart, common.StatusCancelled, PartyServiceProvider, 2000, 20000, 0,
+			[]string{"returnFunds 200.00 USD"}, 0, 0},
+		{"Service Provider cancelling refunds what was paid", common.StatusWorkInProgress, common.StatusCancelled, PartyServiceProvider, 2000, 0, 30000,
+			[]string{"Refund 300.00 USD"}, 0, 0},
+		{"Customer cancelling leaves the fee out of the hold", common.StatusPendingStart, common.StatusCancelled, PartyCustomer, 2000, 20000, 0,
+			[]string{"releaseFunds 50.00 USD", "returnFunds 150.00 USD"}, 0, 5000},
+		{"Customer cancelling leaves the fee out of what was paid", common.StatusWorkInProgress, common.StatusCancelled, PartyCustomer, 2000, 0, 30000,
+			[]string{"Refund 250.00 USD"}, 0, 5000},
+	}
+	for _, c := range cases {
+		res := common.Service_agreement{AgreementID: "SA1", Status: c.from, CustomerId: "C1", ServiceProviderId: "S1",
+			DueAmount: usd(100000), InitialPaymentPercentage: c.percentage, CancellationFee: usd(5000), HeldAmount: usd(c.held), PaidAmount: usd(c.paid)}
+		transition, err := findTransition(c.from, c.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stub := &fakeStub{}
+		err = applyTransition(common.RecordEvents(stub), &res, transition, c.party, "payments", "accounts")
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		transfers := stub.transfers()
+		if strings.Join(transfers, ", ") != strings.Join(c.transfers, ", ") {
+			t.Errorf("%s: transfers = %v, want %v", c.name, transfers, c.transfers)
+		}
+		if res.HeldAmount != usd(c.heldAfter) || res.PaidAmount != usd(c.paidAfter) {
+			t.Errorf("%s: held %v and paid %v, want %d and %d USD cents", c.name, res.HeldAmount, res.PaidAmount, c.heldAfter, c.paidAfter)
+		}
+	}
+}
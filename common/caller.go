@@ -0,0 +1,144 @@
+package common
+
+import (
+"encoding/json"
+"errors"
+"fmt"
+
+"github.com/golang/protobuf/proto"
+"github.com/hyperledger/fabric/core/chaincode/shim"
+"github.com/hyperledger/fabric/protos"
+)
+
+// ============================================================================================================================
+// CallerChaincode - the name of the chaincode the transaction was sent to. A chaincode invoked by another chaincode runs
+// within the same transaction, so this is the name of the calling chaincode, or its own name when it was called directly.
+//
+// This relies on how the Fabric 0.6 peer runs a chaincode-to-chaincode call: the called chaincode is executed with the
+// security context of the transaction that started the call chain, so its GetPayload returns the ChaincodeInvocationSpec
+// the client signed, naming the chaincode it was sent to, and not a spec built for the nested call. A chaincode cannot
+// forge it: the spec is part of the signed transaction. The name is the deployed name, the one registered through Init.
+// Only the top of the chain is known: a chain of three chaincodes names the first one to the third.
+// ============================================================================================================================
+func CallerChaincode(stub shim.ChaincodeStubInterface) (string, error) {
+	payload, err := stub.GetPayload()
+	if err != nil {
+		return "", errors.New("Failed to get the transaction payload: " + err.Error())
+	}
+	invocation := &protos.ChaincodeInvocationSpec{}
+	err = proto.Unmarshal(payload, invocation)
+	if err != nil {
+		return "", errors.New("Failed to read the transaction payload: " + err.Error())
+	}
+	if invocation.ChaincodeSpec == nil || invocation.ChaincodeSpec.ChaincodeID == nil || invocation.ChaincodeSpec.ChaincodeID.Name == "" {
+		return "", errors.New("The transaction payload does not name a chaincode.")
+	}
+	return invocation.ChaincodeSpec.ChaincodeID.Name, nil
+}
+
+var AllowedCallersKey = "_AllowedCallerChaincodes"	//name for the key/value that stores the chaincodes allowed to call the protected functions of a chaincode
+
+// ============================================================================================================================
+// RegisterAllowedCallers - store the names of the chaincodes allowed to call the protected functions, as given to Init, i.e.
+// the deployed 'Agreement' chaincode. Empty names are skipped, and an empty list keeps the names already registered.
+// ============================================================================================================================
+func RegisterAllowedCallers(stub shim.ChaincodeStubInterface, names []string) ([]string, error) {
+	allowedCallers := []string{}
+	for _, name := range names {
+		if name != "" {
+			allowedCallers = append(allowedCallers, name)
+		}
+	}
+	if len(allowedCallers) == 0 {
+		return allowedCallers, nil
+	}
+	allowedAsBytes, err := json.Marshal(allowedCallers)
+	if err != nil {
+		return nil, err
+	}
+	return allowedCallers, stub.PutState(AllowedCallersKey, allowedAsBytes)
+}
+
+// ============================================================================================================================
+// GetAllowedCallers - the names of the chaincodes allowed to call the protected functions, as registered at Init
+// ============================================================================================================================
+func GetAllowedCallers(stub shim.ChaincodeStubInterface) ([]string, error) {
+	allowedCallers := []string{}
+	allowedAsBytes, err := stub.GetState(AllowedCallersKey)
+	if err != nil {
+		return nil, errors.New("Failed to get the allowed caller chaincodes")
+	}
+	if len(allowedAsBytes) == 0 {
+		return allowedCallers, nil
+	}
+	err = json.Unmarshal(allowedAsBytes, &allowedCallers)
+	if err != nil {
+		return nil, errors.New("The allowed caller chaincodes cannot be read: " + err.Error())
+	}
+	return allowedCallers, nil
+}
+
+// ============================================================================================================================
+// RequireCallerChaincode - check that the transaction went through one of the allowed caller chaincodes. what names the
+// protected calls in the error, e.g. "Balance updates".
+// ============================================================================================================================
+func RequireCallerChaincode(stub shim.ChaincodeStubInterface, what string) error {
+	callerChaincode, err := CallerChaincode(stub)
+	if err != nil {
+		return err
+	}
+	called, err := CalledByChaincode(stub)
+	if err != nil {
+		return err
+	}
+	if called {
+		return nil
+	}
+	return NewError(CodeUnauthorized, what + " are only accepted from the registered agreement chaincode, not from " + callerChaincode + ".")
+}
+
+// ============================================================================================================================
+// CalledByChaincode - whether this chaincode runs because one of the allowed caller chaincodes called it, rather than
+// because the transaction was sent to it
+// ============================================================================================================================
+func CalledByChaincode(stub shim.ChaincodeStubInterface) (bool, error) {
+	allowedCallers, err := GetAllowedCallers(stub)
+	if err != nil || len(allowedCallers) == 0 {
+		return false, err
+	}
+	callerChaincode, err := CallerChaincode(stub)
+	if err != nil {
+		return false, err
+	}
+	for _, allowed := range allowedCallers {
+		if callerChaincode == allowed {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ============================================================================================================================
+// QueryAllowedCallers - answer the getAllowedCallers query of a chaincode with the chaincodes allowed to call its protected
+// functions
+// ============================================================================================================================
+func QueryAllowedCallers(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	allowedCallers, err := GetAllowedCallers(stub)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]interface{}{"allowedCallers": allowedCallers})
+}
+
+// ============================================================================================================================
+// RejectSecurity - log a refused call to a protected function in the peer log and return err as an unauthorized Error. No
+// audit record can be kept on the ledger: the refusal fails the transaction, and Fabric drops both the state and the event
+// of a failed transaction, so the peer log is the only trace of the attempt.
+// ============================================================================================================================
+func RejectSecurity(stub shim.ChaincodeStubInterface, function string, err error) ([]byte, error) {
+	message := AsError(err).Message
+	caller, _ := GetIdentity(stub)
+	callerChaincode, _ := CallerChaincode(stub)
+	fmt.Println("Security: " + function + " refused for " + caller.OwnerId + " through " + callerChaincode + ": " + message)
+	return nil, NewError(CodeUnauthorized, message)
+}
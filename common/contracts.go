@@ -0,0 +1,258 @@
+package common
+
+// The calls the 'Agreement' chaincode makes to the 'Account' and 'Payment' chaincodes. The caller builds a request and
+// sends its Args, the called chaincode reads them back with the matching Parse function, so both sides share one
+// definition of the argument order.
+
+// Functions called across chaincodes
+var FunctionUpdateAccountBalance = "updateAccountBalance"
+var FunctionHoldFunds = "holdFunds"
+var FunctionReleaseFunds = "releaseFunds"
+var FunctionReturnFunds = "returnFunds"
+var FunctionCreatePayment = "createPayment"
+
+// Operations of updateAccountBalance. The Customer pays the Service Provider for Initial, Milestone and Final payments,
+// the Service Provider pays the Customer a Penalty or Refund.
+var OperationInitial = "Initial"
+var OperationMilestone = "Milestone"
+var OperationFinal = "Final"
+var OperationPenalty = "Penalty"
+var OperationRefund = "Refund"
+
+// Operations of the escrow functions and of opening an account, as recorded on their journals
+var OperationHold = "Hold"
+var OperationRelease = "Release"
+var OperationReturn = "Return"
+var OperationOpening = "Opening"
+
+// ChaincodeRequest is a call to a function of another chaincode
+type ChaincodeRequest interface{
+	Function() string
+	Args() []string
+}
+
+// ============================================================================================================================
+// InvokeArgs - the arguments to pass to stub.InvokeChaincode for a request: its function followed by its arguments
+// ============================================================================================================================
+func InvokeArgs(request ChaincodeRequest) [][]byte {
+	invokeArgs := [][]byte{[]byte(request.Function())}
+	for _, arg := range request.Args() {
+		invokeArgs = append(invokeArgs, []byte(arg))
+	}
+	return invokeArgs
+}
+
+// Settlement is returned by the balance and escrow functions of the 'Account' chaincode to describe the transfer made
+type Settlement struct{
+	JournalId string `json:"journalId"`
+	Operation string `json:"operation"`
+	PayerId string `json:"payerId"`
+	PayeeId string `json:"payeeId"`
+	Amount Money `json:"amount"` // credited to the payee, in the agreement currency
+	PayerAmount Money `json:"payerAmount"` // debited from the payer, in its home currency
+	FxRate string `json:"fxRate,omitempty"` // rate used for the conversion, empty when none was needed
+	AgreementId string `json:"agreementId,omitempty"` // set for escrow operations
+}
+
+// ============================================================================================================================
+// BalanceUpdated - the event for the transfer, emitted by the 'Account' chaincode when it is called directly and by the
+// 'Agreement' chaincode for the transfers it made
+// ============================================================================================================================
+func (settlement Settlement) BalanceUpdated() *BalanceUpdated {
+	return &BalanceUpdated{
+		Operation: settlement.Operation,
+		JournalId: settlement.JournalId,
+		PayerId: settlement.PayerId,
+		PayeeId: settlement.PayeeId,
+		Amount: settlement.Amount,
+		PayerAmount: settlement.PayerAmount,
+		FxRate: settlement.FxRate,
+		AgreementId: settlement.AgreementId,
+	}
+}
+
+// UpdateBalanceRequest moves an amount between the Customer and the Service Provider of an agreement
+type UpdateBalanceRequest struct{
+	CustomerId string
+	ServiceProviderId string
+	Amount Money
+	Operation string
+}
+
+func (request UpdateBalanceRequest) Function() string {
+	return FunctionUpdateAccountBalance
+}
+
+func (request UpdateBalanceRequest) Args() []string {
+	return []string{request.CustomerId, request.ServiceProviderId, request.Amount.String(), request.Operation}
+}
+
+// ============================================================================================================================
+// ParseUpdateBalanceRequest - read the arguments of updateAccountBalance
+// ============================================================================================================================
+func ParseUpdateBalanceRequest(args []string) (UpdateBalanceRequest, error) {
+	request := UpdateBalanceRequest{}
+	if len(args) != 4 {
+		return request, NewError(CodeValidation, "Incorrect number of arguments. Expecting Customer Account Id, Service Provider Account Id, Amount paid and operation as arguments.")
+	}
+	amount, err := ParseMoney(args[2])
+	if err != nil {
+		return request, err
+	}
+	return UpdateBalanceRequest{args[0], args[1], amount, args[3]}, nil
+}
+
+// ============================================================================================================================
+// PayerAndPayee - who pays whom for the operation of the request
+// ============================================================================================================================
+func (request UpdateBalanceRequest) PayerAndPayee() (string, string, error) {
+	if request.Operation == OperationInitial || request.Operation == OperationMilestone || request.Operation == OperationFinal {
+		return request.CustomerId, request.ServiceProviderId, nil
+	}else if request.Operation == OperationPenalty || request.Operation == OperationRefund {
+		return request.ServiceProviderId, request.CustomerId, nil
+	}
+	return "", "", NewError(CodeValidation, "Unknown operation " + request.Operation + ". Expecting Initial, Milestone, Final, Penalty or Refund.")
+}
+
+// HoldFundsRequest reserves a payment of the Customer in escrow for an agreement
+type HoldFundsRequest struct{
+	AgreementId string
+	CustomerId string
+	ServiceProviderId string
+	Amount Money
+}
+
+func (request HoldFundsRequest) Function() string {
+	return FunctionHoldFunds
+}
+
+func (request HoldFundsRequest) Args() []string {
+	return []string{request.AgreementId, request.CustomerId, request.ServiceProviderId, request.Amount.String()}
+}
+
+// ============================================================================================================================
+// ParseHoldFundsRequest - read the arguments of holdFunds
+// ============================================================================================================================
+func ParseHoldFundsRequest(args []string) (HoldFundsRequest, error) {
+	request := HoldFundsRequest{}
+	if len(args) != 4 {
+		return request, NewError(CodeValidation, "Incorrect number of arguments. Expecting Agreement Id, Customer Account Id, Service Provider Account Id and Amount as arguments.")
+	}
+	amount, err := ParseMoney(args[3])
+	if err != nil {
+		return request, err
+	}
+	return HoldFundsRequest{args[0], args[1], args[2], amount}, nil
+}
+
+// SettleHoldRequest releases funds held for an agreement to the Service Provider, or returns them to the Customer. An
+// Amount without a currency settles everything still held.
+type SettleHoldRequest struct{
+	AgreementId string
+	Amount Money
+	ToServiceProvider bool
+}
+
+func (request SettleHoldRequest) Function() string {
+	if request.ToServiceProvider {
+		return FunctionReleaseFunds
+	}
+	return FunctionReturnFunds
+}
+
+func (request SettleHoldRequest) Args() []string {
+	if request.Amount.Currency == "" {
+		return []string{request.AgreementId}
+	}
+	return []string{request.AgreementId, request.Amount.String()}
+}
+
+// ============================================================================================================================
+// ParseSettleHoldRequest - read the arguments of releaseFunds or returnFunds
+// ============================================================================================================================
+func ParseSettleHoldRequest(args []string, toServiceProvider bool) (SettleHoldRequest, error) {
+	request := SettleHoldRequest{ToServiceProvider: toServiceProvider}
+	if len(args) != 1 && len(args) != 2 {
+		return request, NewError(CodeValidation, "Incorrect number of arguments. Expecting Agreement Id and optionally an Amount as arguments.")
+	}
+	request.AgreementId = args[0]
+	if len(args) == 2 && args[1] != "" {
+		amount, err := ParseMoney(args[1])
+		if err != nil {
+			return request, err
+		}
+		request.Amount = amount
+	}
+	return request, nil
+}
+
+// CreatePaymentRequest records a Payment. The 'Payment' chaincode answers with the Id of the Payment.
+type CreatePaymentRequest struct{
+	AgreementId string
+	PaymentType string
+	CustomerAccount string
+	ReceiverAccount string
+	AmountPaid Money
+	PayerAmount Money // debited from the payer in its home currency, AmountPaid when left empty
+	FxRate string // required when PayerAmount is in another currency than AmountPaid
+	IdempotencyKey string // a retried request with the same key resolves to the Payment created the first time
+	RelatedPaymentId string // for a Refund, the Payment being refunded
+}
+
+func (request CreatePaymentRequest) Function() string {
+	return FunctionCreatePayment
+}
+
+func (request CreatePaymentRequest) Args() []string {
+	payerAmount := request.PayerAmount
+	if payerAmount.Currency == "" {
+		payerAmount = request.AmountPaid
+	}
+	return []string{request.AgreementId, request.PaymentType, request.CustomerAccount, request.ReceiverAccount, request.AmountPaid.String(), payerAmount.String(), request.FxRate, request.IdempotencyKey, request.RelatedPaymentId}
+}
+
+// ============================================================================================================================
+// ParseCreatePaymentRequest - read the arguments of createPayment: 5 arguments, optionally followed by the payer amount
+// and FX rate, an idempotency key and a related Payment Id
+// ============================================================================================================================
+func ParseCreatePaymentRequest(args []string) (CreatePaymentRequest, error) {
+	request := CreatePaymentRequest{}
+	if len(args) < 5 || len(args) == 6 || len(args) > 9 {
+		return request, NewError(CodeValidation, "Incorrect number of arguments. Expecting 5 arguments, optionally followed by the payer amount and FX rate, an idempotency key and a related Payment Id.")
+	}
+	if len(args[0]) <= 0 {
+		return request, NewError(CodeValidation, "Agreement Id cannot be empty.")
+	}else if len(args[1]) <= 0 {
+		return request, NewError(CodeValidation, "Payment Type cannot be empty.")
+	}else if len(args[2]) <= 0 {
+		return request, NewError(CodeValidation, "Customer Payment cannot be empty.")
+	}else if len(args[3]) <= 0 {
+		return request, NewError(CodeValidation, "Receiver Payment cannot be empty.")
+	}else if len(args[4]) <= 0 {
+		return request, NewError(CodeValidation, "Amount Paid cannot be empty.")
+	}
+	request.AgreementId = args[0]
+	request.PaymentType = args[1]
+	request.CustomerAccount = args[2]
+	request.ReceiverAccount = args[3]
+	amountPaid, err := ParseMoney(args[4]) // e.g. "1250.50 USD"
+	if err != nil {
+		return request, err
+	}
+	request.AmountPaid = amountPaid
+	request.PayerAmount = amountPaid
+	if len(args) >= 7 {
+		request.PayerAmount, err = ParseMoney(args[5])
+		if err != nil {
+			return request, err
+		}
+		request.FxRate = args[6]
+	}
+	if len(args) >= 8 {
+		request.IdempotencyKey = args[7]
+	}
+	if len(args) == 9 {
+		request.RelatedPaymentId = args[8]
+	}
+	return request, nil
+}
@@ -0,0 +1,90 @@
+package common
+
+import (
+"encoding/json"
+"strings"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Error codes. Clients branch on them, so a code is never renamed or given another meaning.
+var CodeValidation = "VALIDATION"					//the arguments are malformed or break a business rule
+var CodeNotFound = "NOT_FOUND"						//the record asked for does not exist
+var CodeConflict = "CONFLICT"						//the record exists already, or its state does not allow the call
+var CodeUnauthorized = "UNAUTHORIZED"				//the caller may not do what it asked
+var CodeInsufficientFunds = "INSUFFICIENT_FUNDS"	//the payer cannot cover the amount within its credit limit
+var CodeChaincodeCall = "CHAINCODE_CALL_FAILED"		//a call to another chaincode failed, its error is the cause
+var CodeInternal = "INTERNAL"						//reading or writing the ledger failed
+
+// Error is the error every chaincode function fails with. Its text is its JSON form, which is what the caller of the
+// transaction sees.
+type Error struct{
+	Code string `json:"code"`
+	Message string `json:"message"`
+	Cause *Error `json:"cause,omitempty"`	//for a failed chaincode call, the error of the called chaincode
+}
+
+// ============================================================================================================================
+// NewError - an error with the given code
+// ============================================================================================================================
+func NewError(code string, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	errorAsBytes, _ := json.Marshal(e)
+	return string(errorAsBytes)
+}
+
+// ============================================================================================================================
+// AsError - the Error behind err; an error that has no code is a ledger or runtime failure and gets CodeInternal
+// ============================================================================================================================
+func AsError(err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return NewError(CodeInternal, err.Error())
+}
+
+// ============================================================================================================================
+// ErrorCode - the code of err, empty for no error
+// ============================================================================================================================
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	return AsError(err).Code
+}
+
+// ============================================================================================================================
+// ChaincodeCallError - the error for a failed call to another chaincode. The error of the called chaincode is kept as
+// the cause when it can be read from the text the peer returns, so that e.g. insufficient funds reach the caller.
+// ============================================================================================================================
+func ChaincodeCallError(chaincode string, function string, err error) *Error {
+	e := NewError(CodeChaincodeCall, "Call to " + function + " of chaincode " + chaincode + " failed: " + err.Error())
+	text := err.Error()
+	start, end := strings.Index(text, "{"), strings.LastIndex(text, "}")
+	if start >= 0 && end > start {
+		cause := &Error{}
+		if json.Unmarshal([]byte(text[start:end + 1]), cause) == nil && cause.Code != "" {
+			e.Cause = cause
+		}
+	}
+	return e
+}
+
+// ============================================================================================================================
+// Raise - return err as an Error, so that the transaction fails and nothing it wrote is committed. Every chaincode function,
+// invoke or query, fails through Raise or RaiseError; helpers return the coded error for it. No event is set for it: a
+// failed transaction keeps none, the caller learns of the failure from the error itself.
+// ============================================================================================================================
+func Raise(stub shim.ChaincodeStubInterface, err error) ([]byte, error) {
+	return nil, AsError(err)
+}
+
+// ============================================================================================================================
+// RaiseError - Raise a new error with the given code
+// ============================================================================================================================
+func RaiseError(stub shim.ChaincodeStubInterface, code string, message string) ([]byte, error) {
+	return Raise(stub, NewError(code, message))
+}
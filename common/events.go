@@ -0,0 +1,222 @@
+package common
+
+import (
+"encoding/json"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// EventSchemaVersion is the version of the event payloads below. It changes whenever a field is renamed, removed or
+// changes meaning; adding a field keeps the version.
+var EventSchemaVersion = "2"
+
+// Event names. Fabric keeps a single event per transaction, the last one set, and drops it when the transaction fails.
+// So a chaincode function does not set its events one by one: they are collected by an EventRecorder and set together as
+// one TransactionCompleted event once the function succeeded. Listeners subscribe to TransactionCompleted and pick the
+// events they need by their eventType.
+var EventTransactionCompleted = "TransactionCompleted"
+var EventAccountCreated = "AccountCreated"
+var EventBalanceUpdated = "BalanceUpdated"
+var EventCreditLimitChanged = "CreditLimitChanged"
+var EventFxRateSet = "FxRateSet"
+var EventAgreementStatusChanged = "AgreementStatusChanged"
+var EventMilestoneStatusChanged = "MilestoneStatusChanged"
+var EventPenaltyApplied = "PenaltyApplied"
+var EventPaymentCreated = "PaymentCreated"
+var EventAdminActionPerformed = "AdminActionPerformed"
+
+// EventHeader is carried by every event. The TxId ties the event to its transaction; the CorrelationId is the agreement
+// or account the event is about.
+type EventHeader struct{
+	SchemaVersion string `json:"schemaVersion"`
+	EventType string `json:"eventType"`
+	TxId string `json:"txId"`
+	CorrelationId string `json:"correlationId,omitempty"`
+	Timestamp int64 `json:"timestamp"`
+}
+
+func (header *EventHeader) eventHeader() *EventHeader {
+	return header
+}
+
+// Event is any of the event types below
+type Event interface{
+	eventHeader() *EventHeader
+}
+
+type AccountCreated struct{
+	EventHeader
+	AccountOwnerId string `json:"accountOwnerId"`
+	AccountName string `json:"accountName"`
+	Currency string `json:"currency"`
+	Balances map[string]Money `json:"balances"`
+	CreditLimit Money `json:"creditLimit"`
+}
+
+// BalanceUpdated is a posted journal moving funds between accounts: a payment, penalty or refund, or escrow being held,
+// released or returned
+type BalanceUpdated struct{
+	EventHeader
+	Operation string `json:"operation"`
+	JournalId string `json:"journalId"`
+	PayerId string `json:"payerId"`
+	PayeeId string `json:"payeeId"`
+	Amount Money `json:"amount"` // credited to the payee
+	PayerAmount Money `json:"payerAmount"` // debited from the payer, in its home currency
+	FxRate string `json:"fxRate,omitempty"`
+	AgreementId string `json:"agreementId,omitempty"` // set for escrow operations
+}
+
+type CreditLimitChanged struct{
+	EventHeader
+	AccountOwnerId string `json:"accountOwnerId"`
+	CreditLimit Money `json:"creditLimit"`
+}
+
+type FxRateSet struct{
+	EventHeader
+	FromCurrency string `json:"fromCurrency"`
+	ToCurrency string `json:"toCurrency"`
+	Rate string `json:"rate"`
+}
+
+// AgreementStatusChanged is an agreement being created (with an empty From) or moved to another status
+type AgreementStatusChanged struct{
+	EventHeader
+	AgreementId string `json:"agreementId"`
+	From string `json:"from"`
+	To string `json:"to"`
+	UpdatedBy string `json:"updatedBy"`
+	DisputeId string `json:"disputeId,omitempty"` // set when a dispute is raised or resolved
+	Reason string `json:"reason,omitempty"`
+}
+
+type MilestoneStatusChanged struct{
+	EventHeader
+	AgreementId string `json:"agreementId"`
+	MilestoneId string `json:"milestoneId"`
+	From string `json:"from"`
+	To string `json:"to"`
+	UpdatedBy string `json:"updatedBy"`
+	PaymentId string `json:"paymentId,omitempty"` // set when an accepted milestone is paid
+}
+
+type PenaltyApplied struct{
+	EventHeader
+	AgreementId string `json:"agreementId"`
+	Amount Money `json:"amount"`
+	Periods []int64 `json:"periods"` // penalty periods charged by this event
+	PenaltyCharged Money `json:"penaltyCharged"` // total charged on the agreement so far
+}
+
+type PaymentCreated struct{
+	EventHeader
+	PaymentId string `json:"paymentId"`
+	AgreementId string `json:"agreementId"`
+	PaymentType string `json:"paymentType"`
+	CustomerAccount string `json:"customerAccount"`
+	ReceiverAccount string `json:"receiverAccount"`
+	AmountPaid Money `json:"amountPaid"`
+	PayerAmount Money `json:"payerAmount"`
+	FxRate string `json:"fxRate,omitempty"`
+	RelatedPaymentId string `json:"relatedPaymentId,omitempty"`
+}
+
+// AdminActionPerformed is a chaincode being initialized or maintained by an admin
+type AdminActionPerformed struct{
+	EventHeader
+	Chaincode string `json:"chaincode"`
+	Action string `json:"action"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// TransactionCompleted is the one event set on a successful transaction: the events of the function that was called, in
+// the order they happened. For the 'Agreement' chaincode they include the BalanceUpdated and PaymentCreated events of
+// the 'Account' and 'Payment' chaincodes it called, which do not set events of their own when called by it.
+type TransactionCompleted struct{
+	EventHeader
+	Function string `json:"function"`
+	Events []json.RawMessage `json:"events"`
+}
+
+// EventRecorder is the stub a chaincode function runs with. It keeps the events the function emits, for Publish to set
+// them as one TransactionCompleted event.
+type EventRecorder struct{
+	shim.ChaincodeStubInterface
+	events []json.RawMessage
+}
+
+// ============================================================================================================================
+// RecordEvents - the EventRecorder to run a function with; a stub that already is one is returned as it is, so that Init
+// called from Invoke records into the same transaction
+// ============================================================================================================================
+func RecordEvents(stub shim.ChaincodeStubInterface) *EventRecorder {
+	if recorder, ok := stub.(*EventRecorder); ok {
+		return recorder
+	}
+	return &EventRecorder{ChaincodeStubInterface: stub}
+}
+
+// ============================================================================================================================
+// Publish - set the recorded events as the TransactionCompleted event of the transaction. Nothing is set when the
+// function emitted no event, or when it was called by an allowed caller chaincode, which publishes what the call did.
+// ============================================================================================================================
+func (recorder *EventRecorder) Publish(function string) error {
+	if len(recorder.events) == 0 {
+		return nil
+	}
+	called, err := CalledByChaincode(recorder)
+	if err != nil {
+		return err
+	}
+	if called {
+		recorder.events = nil
+		return nil
+	}
+	event := &TransactionCompleted{Function: function, Events: recorder.events}
+	err = fillHeader(recorder, EventTransactionCompleted, "", event)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	recorder.events = nil
+	return recorder.SetEvent(EventTransactionCompleted, payload)
+}
+
+// ============================================================================================================================
+// EmitEvent - fill in the header of an event and add it to the events of the transaction. The stub must be the
+// EventRecorder the function runs with.
+// ============================================================================================================================
+func EmitEvent(stub shim.ChaincodeStubInterface, eventType string, correlationId string, event Event) error {
+	recorder, ok := stub.(*EventRecorder)
+	if !ok {
+		return NewError(CodeInternal, "Event " + eventType + " emitted outside of an EventRecorder")
+	}
+	err := fillHeader(stub, eventType, correlationId, event)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	recorder.events = append(recorder.events, payload)
+	return nil
+}
+
+func fillHeader(stub shim.ChaincodeStubInterface, eventType string, correlationId string, event Event) error {
+	header := event.eventHeader()
+	header.SchemaVersion = EventSchemaVersion
+	header.EventType = eventType
+	header.TxId = stub.GetTxID()
+	header.CorrelationId = correlationId
+	timestamp, err := TxTimestamp(stub)
+	if err != nil {
+		return err
+	}
+	header.Timestamp = timestamp
+	return nil
+}
\ No newline at end of file
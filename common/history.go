@@ -0,0 +1,149 @@
+package common
+
+import (
+"encoding/json"
+"errors"
+"fmt"
+"reflect"
+"sort"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var HistoryObjectType = "history~type~id~version"		//every version of a record, under (history~type~id~version, objectType, id, version)
+var HistoryHeadObjectType = "history~head~type~id"		//latest version number of a record, under (history~head~type~id, objectType, id)
+
+// HistoryEntry is one version of a record: the value it was stored with and the transaction that stored it
+type HistoryEntry struct{
+	Version int `json:"version"`
+	TxId string `json:"txId"`
+	Timestamp int64 `json:"timestamp"`
+	Creator Identity `json:"creator"`
+	Value json.RawMessage `json:"value"`
+	Changes []FieldChange `json:"changes"` // what changed since the previous version, filled in by GetHistory
+}
+
+// FieldChange is a field that differs between two versions of a record. Nested fields are named by their path, e.g.
+// "balances.USD.amount". A field that was added has no From, one that was removed has no To.
+type FieldChange struct{
+	Field string `json:"field"`
+	From interface{} `json:"from"`
+	To interface{} `json:"to"`
+}
+
+// the version number is zero padded so that versions sort in order
+func historyVersionKey(objectType string, id string, version int) (string, error) {
+	return CreateCompositeKey(HistoryObjectType, objectType, id, fmt.Sprintf("%010d", version))
+}
+
+// ============================================================================================================================
+// RecordHistory - keep the value just stored for a record as its next version, along with the transaction that stored it
+// ============================================================================================================================
+func RecordHistory(stub shim.ChaincodeStubInterface, objectType string, id string, value []byte) error {
+	headKey, err := CreateCompositeKey(HistoryHeadObjectType, objectType, id)
+	if err != nil {
+		return err
+	}
+	version := 0
+	headAsBytes, err := stub.GetState(headKey)
+	if err != nil {
+		return errors.New("Failed to get the history of " + id)
+	}
+	if len(headAsBytes) != 0 {
+		err = json.Unmarshal(headAsBytes, &version)
+		if err != nil {
+			return errors.New("History of " + id + " cannot be read: " + err.Error())
+		}
+	}
+	version = version + 1
+	timestamp, err := TxTimestamp(stub)
+	if err != nil {
+		return err
+	}
+	creator, _ := GetIdentity(stub)	//whatever the certificate tells, the caller was authorized before anything was stored
+	entry := HistoryEntry{Version: version, TxId: stub.GetTxID(), Timestamp: timestamp, Creator: creator, Value: value}
+	entryAsBytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	key, err := historyVersionKey(objectType, id, version)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(key, entryAsBytes)
+	if err != nil {
+		return err
+	}
+	headAsBytes, _ = json.Marshal(version)
+	return stub.PutState(headKey, headAsBytes)
+}
+
+// ============================================================================================================================
+// GetHistory - every recorded version of a record, oldest first, each with the fields changed since the version before.
+// Records stored before history was kept start with the first change made since.
+// ============================================================================================================================
+func GetHistory(stub shim.ChaincodeStubInterface, objectType string, id string) ([]HistoryEntry, error) {
+	history := []HistoryEntry{}
+	previous := []byte("{}")
+	err := ScanPartialCompositeKey(stub, HistoryObjectType, []string{objectType, id}, func(key string, attributes []string, value []byte) error {
+		entry := HistoryEntry{}
+		err := json.Unmarshal(value, &entry)
+		if err != nil {
+			return errors.New("History of " + id + " cannot be read: " + err.Error())
+		}
+		entry.Changes, err = DiffJSON(previous, entry.Value)
+		if err != nil {
+			return err
+		}
+		previous = entry.Value
+		history = append(history, entry)
+		return nil
+	})
+	return history, err
+}
+
+// ============================================================================================================================
+// DiffJSON - the fields that differ between two JSON objects, descending into nested objects, in field name order
+// ============================================================================================================================
+func DiffJSON(from []byte, to []byte) ([]FieldChange, error) {
+	var fromValue, toValue interface{}
+	err := json.Unmarshal(from, &fromValue)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(to, &toValue)
+	if err != nil {
+		return nil, err
+	}
+	changes := []FieldChange{}
+	diffValues("", fromValue, toValue, &changes)
+	return changes, nil
+}
+
+func diffValues(path string, from interface{}, to interface{}, changes *[]FieldChange) {
+	fromObject, fromIsObject := from.(map[string]interface{})
+	toObject, toIsObject := to.(map[string]interface{})
+	if !fromIsObject || !toIsObject {
+		if !reflect.DeepEqual(from, to) {
+			*changes = append(*changes, FieldChange{path, from, to})
+		}
+		return
+	}
+	fields := []string{}
+	for field := range fromObject {
+		fields = append(fields, field)
+	}
+	for field := range toObject {
+		if _, ok := fromObject[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		fieldPath := field
+		if path != "" {
+			fieldPath = path + "." + field
+		}
+		diffValues(fieldPath, fromObject[field], toObject[field], changes)
+	}
+}
@@ -0,0 +1,108 @@
+package common
+
+import (
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// certificate attributes describing the transaction creator
+var OwnerIdAttribute = "ownerId"			//account owner Id of the caller
+var RoleAttribute = "role"					//what the caller is allowed to do
+var OrganizationAttribute = "organization"	//organization the caller enrolled with
+
+// Roles
+var RoleAdmin = "admin"
+var RoleCustomer = "customer"
+var RoleServiceProvider = "serviceProvider"
+var RoleArbiter = "arbiter"
+var RoleTreasury = "treasury"
+var RoleAuditor = "auditor"			//reads the history of every record, changes nothing
+
+// Identity is who created the transaction, as certified by its enrollment certificate
+type Identity struct{
+	OwnerId string `json:"ownerId"`
+	Role string `json:"role"`
+	Organization string `json:"organization"`
+}
+
+// Policy maps each chaincode function to the roles allowed to call it. Functions missing from the policy cannot be called.
+type Policy map[string][]string
+
+// ============================================================================================================================
+// GetIdentity - read the identity of the transaction creator from its certificate attributes
+// ============================================================================================================================
+func GetIdentity(stub shim.ChaincodeStubInterface) (Identity, error) {
+	identity := Identity{}
+	values := []*string{&identity.OwnerId, &identity.Role, &identity.Organization}
+	for i, attribute := range []string{OwnerIdAttribute, RoleAttribute, OrganizationAttribute} {
+		value, err := stub.ReadCertAttribute(attribute)
+		if err != nil {
+			return identity, NewError(CodeUnauthorized, "Failed to read the " + attribute + " attribute of the caller: " + err.Error())
+		}
+		if len(value) == 0 {
+			return identity, NewError(CodeUnauthorized, "The caller certificate has no " + attribute + " attribute.")
+		}
+		*values[i] = string(value)
+	}
+	return identity, nil
+}
+
+// ============================================================================================================================
+// CallerId - the account owner Id of the transaction creator, read from its enrollment certificate
+// ============================================================================================================================
+func CallerId(stub shim.ChaincodeStubInterface) (string, error) {
+	identity, err := GetIdentity(stub)
+	if err != nil {
+		return "", err
+	}
+	return identity.OwnerId, nil
+}
+
+// HasRole - whether the identity has one of the given roles
+func (identity Identity) HasRole(roles ...string) bool {
+	for _, role := range roles {
+		if identity.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================================================================
+// Authorize - check that the transaction creator has a role the policy allows for the function, returning its identity
+// ============================================================================================================================
+func (policy Policy) Authorize(stub shim.ChaincodeStubInterface, function string) (Identity, error) {
+	identity, err := GetIdentity(stub)
+	if err != nil {
+		return identity, err
+	}
+	roles, ok := policy[function]
+	if !ok {
+		return identity, NewError(CodeUnauthorized, "Function " + function + " is not in the access policy and cannot be called.")
+	}
+	if !identity.HasRole(roles...) {
+		return identity, NewError(CodeUnauthorized, "Role " + identity.Role + " of " + identity.OwnerId + " is not allowed to call " + function + ".")
+	}
+	return identity, nil
+}
+
+// ============================================================================================================================
+// RequireRole - check that the transaction creator has one of the given roles, returning its identity
+// ============================================================================================================================
+func RequireRole(stub shim.ChaincodeStubInterface, roles ...string) (Identity, error) {
+	identity, err := GetIdentity(stub)
+	if err != nil {
+		return identity, err
+	}
+	if !identity.HasRole(roles...) {
+		return identity, NewError(CodeUnauthorized, "Role " + identity.Role + " of " + identity.OwnerId + " is not allowed to do this.")
+	}
+	return identity, nil
+}
+
+// ============================================================================================================================
+// RejectUnauthorized - Raise the error for a caller that is not allowed to do what it asked
+// ============================================================================================================================
+func RejectUnauthorized(stub shim.ChaincodeStubInterface, message string) ([]byte, error) {
+	return RaiseError(stub, CodeUnauthorized, message)
+}
@@ -0,0 +1,44 @@
+package common
+
+import (
+"crypto/sha256"
+"encoding/hex"
+"errors"
+"strconv"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ============================================================================================================================
+// NewID - a record Id derived from the transaction Id. The first record a transaction creates with a prefix is
+// prefix + txId, the following ones get a "-1", "-2", ... sequence suffix. Every endorser computes the same Id.
+// Records are looked up under the composite key (objectType, id) to find the Ids already taken.
+// ============================================================================================================================
+func NewID(stub shim.ChaincodeStubInterface, prefix string, objectType string) (string, error) {
+	base := prefix + stub.GetTxID()
+	id := base
+	for i := 1; ; i++ {
+		key, err := CreateCompositeKey(objectType, id)
+		if err != nil {
+			return "", err
+		}
+		valueAsBytes, err := stub.GetState(key)
+		if err != nil {
+			return "", errors.New("Failed to get state for " + id)
+		}
+		if len(valueAsBytes) == 0 {
+			return id, nil
+		}
+		id = base + "-" + strconv.Itoa(i)
+	}
+}
+
+// ============================================================================================================================
+// IdempotentID - a record Id derived from a caller supplied idempotency key, so that retrying a request with the same
+// key resolves to the record created by the first attempt. The key only has to be unique within scope, e.g. the caller
+// or the agreement, so that two callers picking the same key get different records.
+// ============================================================================================================================
+func IdempotentID(prefix string, scope string, idempotencyKey string) string {
+	hash := sha256.Sum256([]byte(scope + "\x00" + idempotencyKey))
+	return prefix + hex.EncodeToString(hash[:16])
+}
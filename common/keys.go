@@ -0,0 +1,114 @@
+package common
+
+import (
+"errors"
+"strings"
+"unicode/utf8"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Composite keys are laid out the way later Fabric versions lay them out, "\x00" + objectType + "\x00" + attribute + "\x00" ...,
+// so that records can be listed by a range scan over a leading part of the key and the layout carries over on upgrade.
+var compositeKeyNamespace = "\x00"
+var compositeKeySeparator = "\x00"			//U+0000, separates the parts of a key
+var compositeKeyEnd = string(utf8.MaxRune)	//U+10FFFF, sorts after every key that starts with the same parts
+var plainKeyStart = "\x01"					//first key outside the composite key namespace
+
+// ============================================================================================================================
+// CreateCompositeKey - the key of a record of objectType identified by the given attributes, e.g. ("payment~agreement~id",
+// agreementId, paymentId)
+// ============================================================================================================================
+func CreateCompositeKey(objectType string, attributes ...string) (string, error) {
+	err := validateCompositeKeyAttribute(objectType)
+	if err != nil {
+		return "", err
+	}
+	key := compositeKeyNamespace + objectType + compositeKeySeparator
+	for _, attribute := range attributes {
+		err = validateCompositeKeyAttribute(attribute)
+		if err != nil {
+			return "", err
+		}
+		key = key + attribute + compositeKeySeparator
+	}
+	return key, nil
+}
+
+// ============================================================================================================================
+// SplitCompositeKey - the objectType and attributes a composite key was created from
+// ============================================================================================================================
+func SplitCompositeKey(compositeKey string) (string, []string, error) {
+	if !strings.HasPrefix(compositeKey, compositeKeyNamespace) || !strings.HasSuffix(compositeKey, compositeKeySeparator) {
+		return "", nil, errors.New("Key " + compositeKey + " is not a composite key.")
+	}
+	parts := strings.Split(compositeKey[len(compositeKeyNamespace):len(compositeKey) - len(compositeKeySeparator)], compositeKeySeparator)
+	return parts[0], parts[1:], nil
+}
+
+func validateCompositeKeyAttribute(attribute string) error {
+	if !utf8.ValidString(attribute) {
+		return NewError(CodeValidation, "Key part " + attribute + " is not a valid UTF-8 string.")
+	}
+	if strings.Contains(attribute, compositeKeySeparator) || strings.Contains(attribute, compositeKeyEnd) {
+		return NewError(CodeValidation, "Key part " + attribute + " contains a reserved character.")
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// ScanPartialCompositeKey - call fn, in key order, with every record of objectType whose leading attributes are the given
+// ones, along with all the attributes of its key. No attributes lists every record of the type.
+// ============================================================================================================================
+func ScanPartialCompositeKey(stub shim.ChaincodeStubInterface, objectType string, attributes []string, fn func(key string, attributes []string, value []byte) error) error {
+	prefix, err := CreateCompositeKey(objectType, attributes...)
+	if err != nil {
+		return err
+	}
+	return ScanState(stub, prefix, prefix + compositeKeyEnd, func(key string, value []byte) error {
+		_, keyAttributes, err := SplitCompositeKey(key)
+		if err != nil {
+			return err
+		}
+		return fn(key, keyAttributes, value)
+	})
+}
+
+// ============================================================================================================================
+// DeleteCompositeKeys - delete every record of objectType, e.g. the entries of an index about to be rebuilt, returning how
+// many were deleted
+// ============================================================================================================================
+func DeleteCompositeKeys(stub shim.ChaincodeStubInterface, objectType string) (int, error) {
+	keys := []string{}
+	err := ScanPartialCompositeKey(stub, objectType, []string{}, func(key string, attributes []string, value []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		err = stub.DelState(key)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+// ============================================================================================================================
+// ListPlainKeys - every key outside the composite key namespace, in key order: the records and JSON array indexes of the
+// earlier key layout, along with the settings a chaincode keeps under plain keys. Migrations walk these rather than the
+// old indexes, so that records an index lost track of are moved too.
+// ============================================================================================================================
+func ListPlainKeys(stub shim.ChaincodeStubInterface) ([]string, error) {
+	keys := []string{}
+	err := ScanState(stub, plainKeyStart, LastKey, func(key string, value []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
@@ -0,0 +1,203 @@
+package common
+
+import (
+"encoding/json"
+"sort"
+"strconv"
+)
+
+// page sizes of list queries
+var DefaultPageSize = 20
+var MaxPageSize = 100
+
+// sort orders of list queries
+var SortById = "id"
+var SortByDate = "date"
+var SortByAmount = "amount"
+var SortByStatus = "status"
+
+// ListRequest is the filter, sort order and page of a list query, given in JSON as its only argument. Every field is
+// optional: an empty request returns the first page of every record the caller may see, in Id order.
+type ListRequest struct{
+	PageSize int `json:"pageSize"`
+	Bookmark string `json:"bookmark"` // bookmark of the previous page, empty for the first page
+	Status string `json:"status"`
+	CustomerId string `json:"customerId"`
+	ServiceProviderId string `json:"serviceProviderId"`
+	FromDate int64 `json:"fromDate"` // unix seconds, inclusive
+	ToDate int64 `json:"toDate"` // unix seconds, inclusive
+	Currency string `json:"currency"` // currency of minAmount and maxAmount, only records in that currency match them
+	MinAmount string `json:"minAmount"` // decimal amount, e.g. "100.00"
+	MaxAmount string `json:"maxAmount"`
+	SortBy string `json:"sortBy"` // id, date, amount or status
+	Descending bool `json:"descending"`
+	minAmount *Money
+	maxAmount *Money
+}
+
+// ListItem is a record as a list query sees it: the fields it is filtered and sorted by, and the record itself
+type ListItem struct{
+	Id string
+	Status string
+	CustomerId string
+	ServiceProviderId string
+	Date int64
+	Amount Money
+	Record json.RawMessage
+}
+
+// ListPage is the JSON envelope list queries answer with
+type ListPage struct{
+	Records []json.RawMessage `json:"records"`
+	Count int `json:"count"` // records on this page
+	Total int `json:"total"` // records matching the filters, over all pages
+	PageSize int `json:"pageSize"`
+	Bookmark string `json:"bookmark"` // pass it in the next request to get the next page, empty on the last page
+}
+
+// ============================================================================================================================
+// ParseListRequest - decode and validate the JSON argument of a list query, filling in the defaults
+// ============================================================================================================================
+func ParseListRequest(requestJson string) (ListRequest, error) {
+	request := ListRequest{}
+	if requestJson != "" {
+		err := json.Unmarshal([]byte(requestJson), &request)
+		if err != nil {
+			return request, NewError(CodeValidation, "List request must be a JSON object: " + err.Error())
+		}
+	}
+	if request.PageSize == 0 {
+		request.PageSize = DefaultPageSize
+	}
+	if request.PageSize < 0 || request.PageSize > MaxPageSize {
+		return request, NewError(CodeValidation, "pageSize must be between 1 and " + strconv.Itoa(MaxPageSize) + ".")
+	}
+	if request.SortBy == "" {
+		request.SortBy = SortById
+	}
+	if request.SortBy != SortById && request.SortBy != SortByDate && request.SortBy != SortByAmount && request.SortBy != SortByStatus {
+		return request, NewError(CodeValidation, "sortBy must be one of id, date, amount or status.")
+	}
+	if request.FromDate != 0 && request.ToDate != 0 && request.FromDate > request.ToDate {
+		return request, NewError(CodeValidation, "fromDate must not be after toDate.")
+	}
+	if (request.MinAmount != "" || request.MaxAmount != "") && request.Currency == "" {
+		return request, NewError(CodeValidation, "currency is required with minAmount or maxAmount.")
+	}
+	if request.MinAmount != "" {
+		minAmount, err := ParseAmountField("minAmount", request.MinAmount, request.Currency)
+		if err != nil {
+			return request, err
+		}
+		request.minAmount = &minAmount
+	}
+	if request.MaxAmount != "" {
+		maxAmount, err := ParseAmountField("maxAmount", request.MaxAmount, request.Currency)
+		if err != nil {
+			return request, err
+		}
+		request.maxAmount = &maxAmount
+	}
+	if request.minAmount != nil && request.maxAmount != nil && request.minAmount.Amount > request.maxAmount.Amount {
+		return request, NewError(CodeValidation, "minAmount must not be more than maxAmount.")
+	}
+	return request, nil
+}
+
+// ============================================================================================================================
+// Matches - whether a record passes every filter of the request
+// ============================================================================================================================
+func (request ListRequest) Matches(item ListItem) bool {
+	if request.Status != "" && item.Status != request.Status {
+		return false
+	}
+	if request.CustomerId != "" && item.CustomerId != request.CustomerId {
+		return false
+	}
+	if request.ServiceProviderId != "" && item.ServiceProviderId != request.ServiceProviderId {
+		return false
+	}
+	if request.FromDate != 0 && item.Date < request.FromDate {
+		return false
+	}
+	if request.ToDate != 0 && item.Date > request.ToDate {
+		return false
+	}
+	if request.minAmount != nil && (item.Amount.Currency != request.minAmount.Currency || item.Amount.Amount < request.minAmount.Amount) {
+		return false
+	}
+	if request.maxAmount != nil && (item.Amount.Currency != request.maxAmount.Currency || item.Amount.Amount > request.maxAmount.Amount) {
+		return false
+	}
+	return true
+}
+
+// ============================================================================================================================
+// Page - sort the matching records and cut out the page after the request's bookmark. Records are ordered by the sort
+// field and then by Id, so the order is the same on every call and the bookmark, the Id of the last record of a page,
+// tells where the next page starts. It is given every matching record, so the caller has scanned them all already.
+// ============================================================================================================================
+func (request ListRequest) Page(items []ListItem) (ListPage, error) {
+	sort.Sort(listOrder{items, request.SortBy, request.Descending})
+	start := 0
+	if request.Bookmark != "" {
+		start = -1
+		for i, item := range items {
+			if item.Id == request.Bookmark {
+				start = i + 1
+				break
+			}
+		}
+		if start < 0 {
+			return ListPage{}, NewError(CodeValidation, "Bookmark " + request.Bookmark + " no longer matches the filters, start again from the first page.")
+		}
+	}
+	end := start + request.PageSize
+	if end > len(items) {
+		end = len(items)
+	}
+	page := ListPage{Records: []json.RawMessage{}, Total: len(items), PageSize: request.PageSize}
+	for _, item := range items[start:end] {
+		page.Records = append(page.Records, item.Record)
+	}
+	page.Count = len(page.Records)
+	if end < len(items) {
+		page.Bookmark = items[end - 1].Id
+	}
+	return page, nil
+}
+
+// listOrder sorts list items by a field, then by Id
+type listOrder struct{
+	items []ListItem
+	sortBy string
+	descending bool
+}
+
+func (order listOrder) Len() int {
+	return len(order.items)
+}
+
+func (order listOrder) Swap(i, j int) {
+	order.items[i], order.items[j] = order.items[j], order.items[i]
+}
+
+func (order listOrder) Less(i, j int) bool {
+	if order.descending {
+		i, j = j, i
+	}
+	a, b := order.items[i], order.items[j]
+	if order.sortBy == SortByDate && a.Date != b.Date {
+		return a.Date < b.Date
+	}
+	if order.sortBy == SortByAmount && (a.Amount.Currency != b.Amount.Currency || a.Amount.Amount != b.Amount.Amount) {
+		if a.Amount.Currency != b.Amount.Currency {
+			return a.Amount.Currency < b.Amount.Currency
+		}
+		return a.Amount.Amount < b.Amount.Amount
+	}
+	if order.sortBy == SortByStatus && a.Status != b.Status {
+		return a.Status < b.Status
+	}
+	return a.Id < b.Id
+}
@@ -0,0 +1,263 @@
+package common
+
+import (
+"bytes"
+"encoding/json"
+"errors"
+"sort"
+"strconv"
+)
+
+// The records of the three chaincodes. Each chaincode stores its own, the others read them through its queries, so a
+// field changed here changes for every chaincode at once.
+
+// Account names, the kind of party an account belongs to
+var AccountCustomer = "Customer"
+var AccountServiceProvider = "Service Provider"
+
+type Account struct{
+	AccountOwnerId string `json:"accountOwnerId"`
+	AccountName string `json:"accountName"` // Customer or Service Provider
+	Currency string `json:"currency"` // home currency, payments in other currencies are converted into it
+	Balances map[string]Money `json:"balances"` // balance held in each currency
+	CreditLimit Money `json:"creditLimit"` // how far below zero the home currency balance may go
+	Held map[string]Money `json:"held"` // funds reserved in escrow for open agreements, already taken out of Balances
+}
+
+// UnmarshalJSON - read an Account, including those stored before balances were kept per currency, whose single
+// accountBalance becomes the balance of their home currency
+func (a *Account) UnmarshalJSON(data []byte) error {
+	type plainAccount Account		// no methods, so that decoding it does not come back here
+	record := struct{
+		*plainAccount
+		AccountBalance *Money `json:"accountBalance"`
+	}{plainAccount: (*plainAccount)(a)}
+	err := json.Unmarshal(data, &record)
+	if err != nil {
+		return err
+	}
+	if record.AccountBalance != nil && len(a.Balances) == 0 {
+		if a.Currency == "" {
+			a.Currency = record.AccountBalance.Currency
+		}
+		a.Balances = map[string]Money{record.AccountBalance.Currency: *record.AccountBalance}
+	}
+	// a balance must be in the currency it is listed under; a bare number is always read as DefaultCurrency
+	for _, currency := range a.Currencies() {
+		if a.Balances[currency].Currency != currency {
+			return errors.New("Balance listed under " + currency + " is in " + a.Balances[currency].Currency)
+		}
+	}
+	return nil
+}
+
+// Balance - the balance of the account in the given currency
+func (a *Account) Balance(currency string) Money {
+	if balance, ok := a.Balances[currency]; ok {
+		return balance
+	}
+	return Money{Currency: currency}
+}
+
+// Currencies - the currencies the account holds a balance in, sorted so that iteration is deterministic
+func (a *Account) Currencies() []string {
+	currencies := []string{}
+	for currency := range a.Balances {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	return currencies
+}
+
+// AddHeld - add to (or, for a negative amount, take from) the funds shown as held on the account
+func (a *Account) AddHeld(amount Money) {
+	if a.Held == nil {
+		a.Held = make(map[string]Money)
+	}
+	held := a.Held[amount.Currency]
+	held.Currency = amount.Currency
+	held.Amount = held.Amount + amount.Amount
+	if held.IsZero() {
+		delete(a.Held, amount.Currency)
+		return
+	}
+	a.Held[amount.Currency] = held
+}
+
+// Service agreement states
+var StatusPendingCustomerAcceptance = "Pending Customer Acceptance"
+var StatusPendingStart = "Pending start with Service Provider"
+var StatusWorkInProgress = "Work in Progress"
+var StatusWorkSubmitted = "Work Submitted"
+var StatusAccepted = "Accepted"
+var StatusWorkCompleted = "Work Completed" // closed by the earlier flow where completing the work paid for it, kept for existing agreements
+var StatusRejected = "Rejected"
+var StatusCancelled = "Cancelled"
+var StatusDisputed = "Disputed"
+
+type Service_agreement struct{
+	AgreementID string
+	Status string
+	CustomerId string
+	ServiceProviderId string
+	Currency string // currency the agreement is billed in
+	StartDate int64
+	EndDate int64
+	DueAmount Money
+	InitialPaymentPercentage Percentage
+	PenaltyAmount Money
+	PenaltyTimePeriod int64
+	PenaltyCap Money // most that can be charged in penalties, zero for no cap
+	PenaltyStartDate int64 // when the agreement started waiting for the Service Provider, penalty periods count from here
+	PenalizedPeriods []int64 // penalty periods (1 based) already charged
+	PenaltyCharged Money // total penalties charged so far
+	CancellationFee Money // kept by the Service Provider when the Customer cancels after paying
+	PaidAmount Money // paid by the Customer to the Service Provider so far, net of refunds
+	HeldAmount Money // reserved from the Customer in escrow, not yet released or returned
+	InitialPaymentId string // Payment that refunds are linked to: the escrow hold of the initial payment
+	Milestones []Milestone // ordered payment schedule, empty for agreements paid as initial + final payment
+	ArbiterId string // resolves disputes between the parties, disputes cannot be raised without one
+	Disputes []Dispute // every dispute raised on the agreement, the last one is open while the agreement is Disputed
+	AcceptanceWindow int64 // seconds the Customer has to accept submitted work before the Service Provider can claim payment
+	WorkSubmittedDate int64
+	AutoAcceptDate int64 // when the Service Provider can accept the submitted work itself
+	LastUpdatedBy string
+	LastUpdateDate int64
+}
+
+// UnmarshalJSON - read a Service_agreement, including those stored before amounts were fixed-point, whose amounts are
+// bare numbers and whose InitialPaymentPercentage is a fraction of the DueAmount (0.125 for 12.5%) rather than a number of
+// hundredths of a percent
+func (a *Service_agreement) UnmarshalJSON(data []byte) error {
+	type plainAgreement Service_agreement		// no methods, so that decoding it does not come back here
+	record := struct{
+		*plainAgreement
+		InitialPaymentPercentage json.Number
+	}{plainAgreement: (*plainAgreement)(a)}
+	err := json.Unmarshal(data, &record)
+	if err != nil {
+		return err
+	}
+	percentage := record.InitialPaymentPercentage.String()
+	if percentage == "" {
+		a.InitialPaymentPercentage = 0
+		return nil
+	}
+	var amounts struct{
+		DueAmount json.RawMessage
+	}
+	err = json.Unmarshal(data, &amounts)
+	if err != nil {
+		return err
+	}
+	dueAmount := bytes.TrimSpace(amounts.DueAmount)
+	if len(dueAmount) > 0 && dueAmount[0] != '{' && dueAmount[0] != 'n' {
+		value, err := RoundDecimal(percentage, 4)
+		if err != nil {
+			return errors.New("Invalid InitialPaymentPercentage " + percentage + ": " + err.Error())
+		}
+		a.InitialPaymentPercentage = Percentage(value)
+		if a.Currency == "" {
+			a.Currency = DefaultCurrency
+		}
+		a.backfillLegacyPayments()
+		return nil
+	}
+	value, err := strconv.ParseInt(percentage, 10, 64)
+	if err != nil {
+		return errors.New("Invalid InitialPaymentPercentage " + percentage + ": " + err.Error())
+	}
+	a.InitialPaymentPercentage = Percentage(value)
+	return nil
+}
+
+// backfillLegacyPayments sets what a legacy agreement has been paid, which earlier records did not keep. The earlier flow
+// paid the initial part straight to the Service Provider when the agreement left Pending Customer Acceptance and the
+// rest when it reached Work Completed, and held nothing in escrow.
+func (a *Service_agreement) backfillLegacyPayments() {
+	initialPart, _ := a.DueAmount.Split(a.InitialPaymentPercentage)
+	a.HeldAmount = Money{0, a.DueAmount.Currency}
+	if a.PaidAmount.Currency != "" {
+		return
+	}
+	switch a.Status {
+	case "", StatusPendingCustomerAcceptance, StatusRejected:
+		a.PaidAmount = Money{0, a.DueAmount.Currency}
+	case StatusWorkCompleted:
+		a.PaidAmount = a.DueAmount
+	default:
+		a.PaidAmount = initialPart
+	}
+}
+
+// Milestone states
+var MilestonePending = "Pending"
+var MilestoneCompleted = "Completed"
+var MilestoneAccepted = "Accepted"
+
+// Milestone is one step of an agreement's payment schedule, paid when the Customer accepts it
+type Milestone struct{
+	MilestoneId string
+	Description string
+	Amount Money
+	Percentage Percentage // set when the amount was given as a percentage of DueAmount
+	DueDate int64
+	AcceptanceCriteria string
+	Status string
+	CompletedDate int64
+	AcceptedDate int64
+	PaymentId string
+}
+
+// Dispute states
+var DisputeOpen = "Open"
+var DisputeResolved = "Resolved"
+
+// Dispute outcomes the arbiter can record, and the state the agreement moves to for each
+var OutcomeFullPay = "Full Pay"			// the Service Provider is paid everything still due, agreement is Accepted
+var OutcomePartialPay = "Partial Pay"	// the Service Provider is paid part of what is still due, the rest goes back to the Customer
+var OutcomeRefund = "Refund"			// the Customer gets back everything held and paid, agreement is Cancelled
+var OutcomePenalty = "Penalty"			// the Service Provider pays a penalty and the agreement carries on where it was
+
+// Dispute is a disagreement raised by one of the parties. While it is open the agreement is Disputed and none of its
+// payments move; the arbiter closes it with an outcome that decides the transfers.
+type Dispute struct{
+	DisputeId string
+	RaisedBy string
+	Reason string
+	EvidenceHashes []string // hex SHA-256 digests of the evidence documents, kept off chain
+	RaisedDate int64
+	StatusBeforeDispute string
+	Status string
+	Outcome string
+	OutcomeAmount Money // paid to the Service Provider for a partial pay, by it for a penalty
+	Notes string
+	ResolvedBy string
+	ResolvedDate int64
+}
+
+// Payment types, what a recorded Payment was for
+var PaymentEscrowHold = "Escrow Hold"
+var PaymentEscrowRelease = "Escrow Release"
+var PaymentMilestone = "Milestone Payment"
+var PaymentFinal = "Final Payment"
+var PaymentPenalty = "Penalty Payment"
+var PaymentCancellationFee = "Cancellation Fee"
+var PaymentRefund = "Refund"
+var PaymentDisputeSettlement = "Dispute Settlement"
+var PaymentDisputeRefund = "Dispute Refund"
+
+type Payment struct{
+	PaymentId string
+	AgreementId string
+	PaymentType string
+	CustomerAccount string
+	ReceiverAccount string
+	AmountPaid Money
+	Currency string
+	PayerAmount Money // amount debited from the payer, in its account currency
+	FxRate string // rate used to convert AmountPaid into PayerAmount, empty when no conversion was needed
+	RelatedPaymentId string // for a Refund, the Payment being refunded
+	LastUpdatedBy string
+	LastUpdateDate int64
+}
@@ -0,0 +1,71 @@
+package common
+
+import (
+"encoding/json"
+"testing"
+)
+
+func TestUnmarshalLegacyAccount(t *testing.T) {
+	var account Account
+	err := json.Unmarshal([]byte(`{"accountOwnerId":"C1","accountName":"Customer","accountBalance":100.25}`), &account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Currency != DefaultCurrency || account.Balance(DefaultCurrency) != (Money{10025, DefaultCurrency}) {
+		t.Errorf("legacy account = %+v, want a balance of 100.25 %s", account, DefaultCurrency)
+	}
+}
+
+func TestUnmarshalAccountKeepsBalances(t *testing.T) {
+	account := Account{AccountOwnerId: "C1", Currency: "EUR", Balances: map[string]Money{"EUR": {500, "EUR"}, "USD": {-20, "USD"}}}
+	data, err := json.Marshal(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Account
+	err = json.Unmarshal(data, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Balances) != 2 || decoded.Balance("USD").Amount != -20 || decoded.Currency != "EUR" {
+		t.Errorf("decoded account = %+v, want %+v", decoded, account)
+	}
+}
+
+func TestUnmarshalLegacyAgreement(t *testing.T) {
+	var agreement Service_agreement
+	err := json.Unmarshal([]byte(`{"AgreementID":"SA1","DueAmount":1000,"InitialPaymentPercentage":0.125,"PenaltyAmount":10.5}`), &agreement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agreement.DueAmount != (Money{100000, DefaultCurrency}) || agreement.PenaltyAmount != (Money{1050, DefaultCurrency}) {
+		t.Errorf("legacy amounts = %v, %v", agreement.DueAmount, agreement.PenaltyAmount)
+	}
+	if agreement.InitialPaymentPercentage != 1250 || agreement.Currency != DefaultCurrency {
+		t.Errorf("legacy percentage = %d in %q, want 1250 in %s", agreement.InitialPaymentPercentage, agreement.Currency, DefaultCurrency)
+	}
+}
+
+func TestUnmarshalAgreementRoundTrip(t *testing.T) {
+	agreement := Service_agreement{AgreementID: "SA1", Currency: "EUR", DueAmount: Money{100000, "EUR"}, InitialPaymentPercentage: 1250}
+	data, err := json.Marshal(agreement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Service_agreement
+	err = json.Unmarshal(data, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.InitialPaymentPercentage != 1250 || decoded.DueAmount != agreement.DueAmount || decoded.Currency != "EUR" {
+		t.Errorf("decoded agreement = %+v", decoded)
+	}
+}
+
+func TestUnmarshalAccountRefusesBalanceInOtherCurrency(t *testing.T) {
+	var account Account
+	err := json.Unmarshal([]byte(`{"accountOwnerId":"C1","currency":"EUR","balances":{"EUR":100.25}}`), &account)
+	if err == nil {
+		t.Errorf("EUR balance given as a bare number = %v, want an error", account.Balances)
+	}
+}
@@ -0,0 +1,391 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// Package common holds the types shared by the Account, Agreement and Payment chaincodes.
+package common
+
+import (
+"bytes"
+"encoding/json"
+"errors"
+"math/big"
+"strconv"
+"strings"
+)
+
+// DefaultCurrency is used wherever an amount is given without a currency code.
+var DefaultCurrency = "USD"
+
+// number of digits after the decimal point for each supported currency
+var minorUnitDigits = map[string]int{
+	"USD": 2,
+	"EUR": 2,
+	"INR": 2,
+}
+
+// Money is an exact amount of a currency, held as an integer number of minor units (e.g. cents).
+// Its text form, used as the cross-chaincode argument, is "<decimal amount> <currency>", e.g. "1250.50 USD".
+type Money struct{
+	Amount int64 `json:"amount"`		// minor units
+	Currency string `json:"currency"`	// ISO 4217 currency code
+}
+
+// Percentage is a percentage in hundredths of a percent (basis points): 1250 is 12.50%.
+type Percentage int64
+
+// Rate is an exchange rate with RateDigits decimals: the number of units of the target currency for one unit of the source.
+type Rate int64
+
+// RateDigits is the number of decimals kept on an exchange Rate
+var RateDigits = 8
+
+// ============================================================================================================================
+// Digits - number of minor unit digits of a currency, or an error for an unsupported currency
+// ============================================================================================================================
+func Digits(currency string) (int, error) {
+	digits, ok := minorUnitDigits[currency]
+	if !ok {
+		return 0, NewError(CodeValidation, "Unsupported currency " + currency)
+	}
+	return digits, nil
+}
+
+// ============================================================================================================================
+// ParseMoney - parse the text form "<decimal amount> <currency>" of a Money
+// ============================================================================================================================
+func ParseMoney(s string) (Money, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return Money{}, NewError(CodeValidation, "Invalid amount " + strconv.Quote(s) + ". Expecting \"<amount> <currency>\".")
+	}
+	return ParseAmount(fields[0], fields[1])
+}
+
+// ============================================================================================================================
+// ParseAmount - parse a decimal amount of the given currency; more decimals than the currency allows is an error
+// ============================================================================================================================
+func ParseAmount(amount string, currency string) (Money, error) {
+	digits, err := Digits(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	minor, err := parseDecimal(amount, digits)
+	if err != nil {
+		return Money{}, NewError(CodeValidation, "Invalid " + currency + " amount " + strconv.Quote(amount) + ": " + err.Error())
+	}
+	return Money{minor, currency}, nil
+}
+
+// ============================================================================================================================
+// UnmarshalJSON - read a Money stored as {"amount": ..., "currency": ...}, or as the bare number the records held before
+// amounts were fixed-point, e.g. 1250.5, which is taken as an amount of DefaultCurrency. A bare number with more decimals
+// than DefaultCurrency has is an error, it is not rounded.
+// ============================================================================================================================
+func (m *Money) UnmarshalJSON(data []byte) error {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] == '{' || bytes.Equal(trimmed, []byte("null")) {
+		type plainMoney Money		// no methods, so that decoding it does not come back here
+		return json.Unmarshal(data, (*plainMoney)(m))
+	}
+	var number json.Number
+	err := json.Unmarshal(trimmed, &number)
+	if err != nil {
+		return errors.New("Amount must be an object or a number: " + string(trimmed))
+	}
+	digits, err := Digits(DefaultCurrency)
+	if err != nil {
+		return err
+	}
+	amount, err := ExactDecimal(number.String(), digits)
+	if err != nil {
+		return errors.New("Invalid amount " + number.String() + ": " + err.Error())
+	}
+	*m = Money{amount, DefaultCurrency}
+	return nil
+}
+
+// ============================================================================================================================
+// RoundDecimal - convert a number written in decimal or exponent notation, as JSON writes a float64, to an integer scaled by
+// 10^digits, rounding extra decimals half away from zero. Used to read the float percentages of earlier records.
+// ============================================================================================================================
+func RoundDecimal(s string, digits int) (int64, error) {
+	value, err := scaledDecimal(s, digits)
+	if err != nil {
+		return 0, err
+	}
+	rounded := roundBigHalfAwayFromZero(value.Num(), value.Denom())
+	if !rounded.IsInt64() {
+		return 0, errors.New("out of range")
+	}
+	return rounded.Int64(), nil
+}
+
+// ============================================================================================================================
+// ExactDecimal - convert a number written in decimal or exponent notation to an integer scaled by 10^digits. A number with
+// more decimals than that is an error. Used to read the float amounts of earlier records.
+// ============================================================================================================================
+func ExactDecimal(s string, digits int) (int64, error) {
+	value, err := scaledDecimal(s, digits)
+	if err != nil {
+		return 0, err
+	}
+	if !value.IsInt() {
+		return 0, errors.New("at most " + strconv.Itoa(digits) + " decimals are allowed")
+	}
+	if !value.Num().IsInt64() {
+		return 0, errors.New("out of range")
+	}
+	return value.Num().Int64(), nil
+}
+
+// scaledDecimal is the exact value of a decimal or exponent notation number multiplied by 10^digits
+func scaledDecimal(s string, digits int) (*big.Rat, error) {
+	value, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, errors.New("not a number")
+	}
+	return value.Mul(value, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(digits)), nil))), nil
+}
+
+// ============================================================================================================================
+// ParsePercentage - parse a percentage between 0 and 100 with at most two decimals
+// ============================================================================================================================
+func ParsePercentage(s string) (Percentage, error) {
+	value, err := parseDecimal(s, 2)
+	if err != nil {
+		return 0, NewError(CodeValidation, "Invalid percentage " + strconv.Quote(s) + ": " + err.Error())
+	}
+	if value < 0 || value > 10000 {
+		return 0, NewError(CodeValidation, "Percentage " + s + " must be between 0 and 100.")
+	}
+	return Percentage(value), nil
+}
+
+// parseDecimal converts a decimal string to an integer scaled by 10^digits without going through float64
+func parseDecimal(s string, digits int) (int64, error) {
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	parts := strings.SplitN(s, ".", 2)
+	whole := parts[0]
+	fraction := ""
+	if len(parts) == 2 {
+		fraction = parts[1]
+	}
+	if whole == "" && fraction == "" {
+		return 0, errors.New("empty number")
+	}
+	if len(fraction) > digits {
+		return 0, errors.New("at most " + strconv.Itoa(digits) + " decimals are allowed")
+	}
+	fraction = fraction + strings.Repeat("0", digits - len(fraction))
+	if whole == "" {
+		whole = "0"
+	}
+	for _, c := range whole + fraction {
+		if c < '0' || c > '9' {
+			return 0, errors.New("not a number")
+		}
+	}
+	value, err := strconv.ParseInt(whole + fraction, 10, 64)
+	if err != nil {
+		return 0, errors.New("out of range")
+	}
+	if negative {
+		value = -value
+	}
+	return value, nil
+}
+
+// ============================================================================================================================
+// ParseRate - parse a positive exchange rate with at most RateDigits decimals, e.g. "0.92150000"
+// ============================================================================================================================
+func ParseRate(s string) (Rate, error) {
+	value, err := parseDecimal(s, RateDigits)
+	if err != nil {
+		return 0, NewError(CodeValidation, "Invalid exchange rate " + strconv.Quote(s) + ": " + err.Error())
+	}
+	if value <= 0 {
+		return 0, NewError(CodeValidation, "Exchange rate " + s + " must be positive.")
+	}
+	return Rate(value), nil
+}
+
+// ============================================================================================================================
+// String - text form of the Rate, e.g. "0.92150000"
+// ============================================================================================================================
+func (r Rate) String() string {
+	return formatDecimal(int64(r), RateDigits)
+}
+
+// ============================================================================================================================
+// Convert - the amount in another currency at the given rate, rounded to the nearest minor unit of the target currency
+// with halves rounded away from zero
+// ============================================================================================================================
+func (m Money) Convert(rate Rate, currency string) (Money, error) {
+	fromDigits, err := Digits(m.Currency)
+	if err != nil {
+		return Money{}, err
+	}
+	toDigits, err := Digits(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	ten := big.NewInt(10)
+	numerator := new(big.Int).Mul(big.NewInt(m.Amount), big.NewInt(int64(rate)))
+	numerator.Mul(numerator, new(big.Int).Exp(ten, big.NewInt(int64(toDigits)), nil))
+	denominator := new(big.Int).Exp(ten, big.NewInt(int64(RateDigits + fromDigits)), nil)
+	quotient := roundBigHalfAwayFromZero(numerator, denominator)
+	if !quotient.IsInt64() {
+		return Money{}, NewError(CodeValidation, "Converted amount is out of range")
+	}
+	return Money{quotient.Int64(), currency}, nil
+}
+
+// Scale returns the amount multiplied by numerator/denominator, rounded half away from zero. It is used to take the
+// same share of two amounts, e.g. the part of a converted amount that matches a partial release.
+func (m Money) Scale(numerator int64, denominator int64) (Money, error) {
+	if denominator == 0 {
+		return Money{}, NewError(CodeValidation, "Cannot scale an amount by a zero denominator")
+	}
+	product := new(big.Int).Mul(big.NewInt(m.Amount), big.NewInt(numerator))
+	divisor := big.NewInt(denominator)
+	if denominator < 0 {
+		product.Neg(product)
+		divisor.Neg(divisor)
+	}
+	quotient := roundBigHalfAwayFromZero(product, divisor)
+	if !quotient.IsInt64() {
+		return Money{}, NewError(CodeValidation, "Scaled amount is out of range")
+	}
+	return Money{quotient.Int64(), m.Currency}, nil
+}
+
+// roundBigHalfAwayFromZero divides numerator by a positive denominator, rounding half away from zero
+func roundBigHalfAwayFromZero(numerator *big.Int, denominator *big.Int) *big.Int {
+	quotient, remainder := new(big.Int).QuoRem(numerator, denominator, new(big.Int))
+	if new(big.Int).Mul(new(big.Int).Abs(remainder), big.NewInt(2)).Cmp(denominator) >= 0 {
+		if numerator.Sign() < 0 {
+			quotient.Sub(quotient, big.NewInt(1))
+		} else {
+			quotient.Add(quotient, big.NewInt(1))
+		}
+	}
+	return quotient
+}
+
+// ============================================================================================================================
+// String - text form of the Money, e.g. "1250.50 USD"
+// ============================================================================================================================
+func (m Money) String() string {
+	digits, ok := minorUnitDigits[m.Currency]
+	if !ok {
+		digits = 2
+	}
+	return formatDecimal(m.Amount, digits) + " " + m.Currency
+}
+
+// ============================================================================================================================
+// String - text form of the Percentage, e.g. "12.50"
+// ============================================================================================================================
+func (p Percentage) String() string {
+	return formatDecimal(int64(p), 2)
+}
+
+func formatDecimal(value int64, digits int) string {
+	sign := ""
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+	s := strconv.FormatInt(value, 10)
+	if digits == 0 {
+		return sign + s
+	}
+	if len(s) <= digits {
+		s = strings.Repeat("0", digits - len(s) + 1) + s
+	}
+	return sign + s[:len(s)-digits] + "." + s[len(s)-digits:]
+}
+
+// ============================================================================================================================
+// Add / Sub - arithmetic on amounts of the same currency
+// ============================================================================================================================
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, NewError(CodeValidation, "Cannot add " + o.Currency + " to " + m.Currency)
+	}
+	return Money{m.Amount + o.Amount, m.Currency}, nil
+}
+
+func (m Money) Sub(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, NewError(CodeValidation, "Cannot subtract " + o.Currency + " from " + m.Currency)
+	}
+	return Money{m.Amount - o.Amount, m.Currency}, nil
+}
+
+// Neg returns the amount with its sign flipped
+func (m Money) Neg() Money {
+	return Money{-m.Amount, m.Currency}
+}
+
+// IsZero, IsPositive and IsNegative report the sign of the amount
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+func (m Money) IsPositive() bool {
+	return m.Amount > 0
+}
+
+func (m Money) IsNegative() bool {
+	return m.Amount < 0
+}
+
+// ============================================================================================================================
+// Split - split the amount into the given percentage and the remainder. The percentage share is rounded to the nearest
+// minor unit with halves rounded away from zero; the remainder takes whatever is left so that part + rest == m exactly.
+// ============================================================================================================================
+func (m Money) Split(p Percentage) (Money, Money) {
+	part := Money{roundHalfAwayFromZero(m.Amount * int64(p), 10000), m.Currency}
+	rest := Money{m.Amount - part.Amount, m.Currency}
+	return part, rest
+}
+
+// Percent returns the given percentage of the amount, rounded the same way as Split
+func (m Money) Percent(p Percentage) Money {
+	part, _ := m.Split(p)
+	return part
+}
+
+func roundHalfAwayFromZero(numerator int64, denominator int64) int64 {
+	quotient := numerator / denominator
+	remainder := numerator % denominator
+	if remainder < 0 {
+		remainder = -remainder
+	}
+	if remainder * 2 >= denominator {
+		if numerator < 0 {
+			quotient--
+		} else {
+			quotient++
+		}
+	}
+	return quotient
+}
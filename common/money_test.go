@@ -0,0 +1,185 @@
+package common
+
+import (
+"encoding/json"
+"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	cases := []struct{
+		text string
+		amount int64
+		currency string
+	}{
+		{"1250.50 USD", 125050, "USD"},
+		{"1250.5 EUR", 125050, "EUR"},
+		{"1250 INR", 125000, "INR"},
+		{".75 USD", 75, "USD"},
+		{"-3.01 USD", -301, "USD"},
+		{"0 USD", 0, "USD"},
+	}
+	for _, c := range cases {
+		money, err := ParseMoney(c.text)
+		if err != nil {
+			t.Errorf("ParseMoney(%q) failed: %v", c.text, err)
+			continue
+		}
+		if money.Amount != c.amount || money.Currency != c.currency {
+			t.Errorf("ParseMoney(%q) = %d %s, want %d %s", c.text, money.Amount, money.Currency, c.amount, c.currency)
+		}
+	}
+}
+
+func TestParseMoneyRejects(t *testing.T) {
+	for _, text := range []string{"", "12.50", "12.50 USD extra", "12.505 USD", "12.50 GBP", "12,50 USD", "1.2.3 USD", "abc USD", ". USD", "99999999999999999999 USD"} {
+		_, err := ParseMoney(text)
+		if err == nil {
+			t.Errorf("ParseMoney(%q) succeeded, want an error", text)
+			continue
+		}
+		if AsError(err).Code != CodeValidation {
+			t.Errorf("ParseMoney(%q) failed with %s, want %s", text, AsError(err).Code, CodeValidation)
+		}
+	}
+}
+
+func TestParsePercentage(t *testing.T) {
+	percentage, err := ParsePercentage("12.5")
+	if err != nil || percentage != 1250 {
+		t.Errorf("ParsePercentage(\"12.5\") = %d, %v, want 1250", percentage, err)
+	}
+	for _, text := range []string{"100.01", "-1", "12.345"} {
+		_, err := ParsePercentage(text)
+		if err == nil {
+			t.Errorf("ParsePercentage(%q) succeeded, want an error", text)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	cases := map[string]Money{
+		"1250.50 USD": {125050, "USD"},
+		"0.05 EUR": {5, "EUR"},
+		"0.00 USD": {0, "USD"},
+		"-0.05 USD": {-5, "USD"},
+	}
+	for want, money := range cases {
+		if money.String() != want {
+			t.Errorf("String() = %q, want %q", money.String(), want)
+		}
+		parsed, err := ParseMoney(want)
+		if err != nil || parsed != money {
+			t.Errorf("ParseMoney(%q) = %v, %v, want %v", want, parsed, err, money)
+		}
+	}
+}
+
+func TestSplitRoundsHalfAwayFromZero(t *testing.T) {
+	cases := []struct{
+		amount int64
+		percentage Percentage
+		part int64
+	}{
+		{1000, 2500, 250},
+		{1, 5000, 1},			// 0.5 rounds up
+		{3, 5000, 2},			// 1.5 rounds up
+		{-1, 5000, -1},			// -0.5 rounds away from zero
+		{333, 3333, 111},		// 110.99 rounds to 111
+		{10001, 10000, 10001},
+	}
+	for _, c := range cases {
+		part, rest := Money{c.amount, "USD"}.Split(c.percentage)
+		if part.Amount != c.part {
+			t.Errorf("Split(%d, %d) part = %d, want %d", c.amount, c.percentage, part.Amount, c.part)
+		}
+		if part.Amount + rest.Amount != c.amount {
+			t.Errorf("Split(%d, %d) parts add up to %d", c.amount, c.percentage, part.Amount + rest.Amount)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	rate, err := ParseRate("0.92150000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	converted, err := Money{10000, "USD"}.Convert(rate, "EUR")
+	if err != nil || converted != (Money{9215, "EUR"}) {
+		t.Errorf("Convert = %v, %v, want 92.15 EUR", converted, err)
+	}
+	// 0.01 * 0.5 = 0.005 rounds away from zero to 0.01
+	half, _ := ParseRate("0.5")
+	converted, err = Money{1, "USD"}.Convert(half, "EUR")
+	if err != nil || converted.Amount != 1 {
+		t.Errorf("Convert(0.01 USD, 0.5) = %v, %v, want 0.01 EUR", converted, err)
+	}
+	converted, err = Money{-1, "USD"}.Convert(half, "EUR")
+	if err != nil || converted.Amount != -1 {
+		t.Errorf("Convert(-0.01 USD, 0.5) = %v, %v, want -0.01 EUR", converted, err)
+	}
+}
+
+func TestScale(t *testing.T) {
+	scaled, err := Money{1000, "EUR"}.Scale(1, 3)
+	if err != nil || scaled.Amount != 333 {
+		t.Errorf("Scale(10.00, 1/3) = %v, %v, want 3.33", scaled, err)
+	}
+	scaled, err = Money{1000, "EUR"}.Scale(2, -3)
+	if err != nil || scaled.Amount != -667 {
+		t.Errorf("Scale(10.00, 2/-3) = %v, %v, want -6.67", scaled, err)
+	}
+	_, err = Money{1000, "EUR"}.Scale(1, 0)
+	if err == nil {
+		t.Errorf("Scale by zero succeeded, want an error")
+	}
+}
+
+func TestAddRejectsMixedCurrencies(t *testing.T) {
+	_, err := Money{100, "USD"}.Add(Money{100, "EUR"})
+	if err == nil {
+		t.Errorf("Add of USD and EUR succeeded, want an error")
+	}
+	sum, err := Money{100, "USD"}.Add(Money{-250, "USD"})
+	if err != nil || sum != (Money{-150, "USD"}) {
+		t.Errorf("Add = %v, %v, want -1.50 USD", sum, err)
+	}
+}
+
+func TestUnmarshalMoney(t *testing.T) {
+	cases := map[string]Money{
+		`{"amount":125050,"currency":"EUR"}`: {125050, "EUR"},
+		`1250.5`: {125050, DefaultCurrency},		// float amount of the earlier records
+		`1250`: {125000, DefaultCurrency},
+		`-0.1`: {-10, DefaultCurrency},
+		`1e+06`: {100000000, DefaultCurrency},
+		`null`: {},
+	}
+	for data, want := range cases {
+		var money Money
+		err := json.Unmarshal([]byte(data), &money)
+		if err != nil || money != want {
+			t.Errorf("Unmarshal(%s) = %v, %v, want %v", data, money, err, want)
+		}
+	}
+	var money Money
+	if json.Unmarshal([]byte(`"12.50 USD"`), &money) == nil {
+		t.Errorf("Unmarshal of a string succeeded, want an error")
+	}
+	// extra decimals are refused rather than rounded
+	if json.Unmarshal([]byte(`100.555`), &money) == nil {
+		t.Errorf("Unmarshal of 100.555 = %v, want an error", money)
+	}
+}
+
+func TestMoneyRoundTrip(t *testing.T) {
+	money := Money{-125050, "INR"}
+	data, err := json.Marshal(money)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Money
+	err = json.Unmarshal(data, &decoded)
+	if err != nil || decoded != money {
+		t.Errorf("round trip of %s = %v, %v", data, decoded, err)
+	}
+}
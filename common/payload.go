@@ -0,0 +1,158 @@
+package common
+
+import (
+"encoding/json"
+"reflect"
+"sort"
+"strconv"
+"strings"
+)
+
+// ============================================================================================================================
+// DecodePayload - decode the JSON object given as the only argument of a create or update function into request, a pointer
+// to a struct. A field the struct does not declare, or a value of the wrong type, is rejected with the name of the field,
+// so that nothing the caller sent is silently dropped or zeroed.
+// ============================================================================================================================
+func DecodePayload(args []string, name string, request interface{}) error {
+	if len(args) != 1 || strings.TrimSpace(args[0]) == "" {
+		return NewError(CodeValidation, "Incorrect number of arguments. Expecting the " + name + " as a single JSON object.")
+	}
+	return decodeObject([]byte(args[0]), name, reflect.ValueOf(request).Elem())
+}
+
+// decodeObject decodes a JSON object field by field into a struct, checking nested objects and lists of objects the same way
+func decodeObject(data []byte, name string, value reflect.Value) error {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(data, &fields)
+	if err != nil || fields == nil {
+		return NewError(CodeValidation, name + " must be a JSON object.")
+	}
+	// fields are checked in a fixed order, so that every peer rejects a bad payload with the same error
+	keys := []string{}
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		raw := fields[key]
+		field, ok := payloadField(value, key)
+		if !ok {
+			return NewError(CodeValidation, "Unknown field " + key + " in " + name + ".")
+		}
+		fieldType := field.Type()
+		if fieldType.Kind() == reflect.Struct {
+			err = decodeObject(raw, key, field)
+			if err != nil {
+				return err
+			}
+		}else if fieldType.Kind() == reflect.Slice && fieldType.Elem().Kind() == reflect.Struct {
+			var items []json.RawMessage
+			err = json.Unmarshal(raw, &items)
+			if err != nil {
+				return NewError(CodeValidation, key + " must be a list of objects.")
+			}
+			list := reflect.MakeSlice(fieldType, len(items), len(items))
+			for i, item := range items {
+				err = decodeObject(item, key + "[" + strconv.Itoa(i) + "]", list.Index(i))
+				if err != nil {
+					return err
+				}
+			}
+			field.Set(list)
+		}else if json.Unmarshal(raw, field.Addr().Interface()) != nil {
+			return NewError(CodeValidation, key + " must be " + payloadKind(fieldType) + ".")
+		}
+	}
+	return nil
+}
+
+// payloadField finds the exported field of a struct that a JSON key maps to, by its json tag or else its name
+func payloadField(value reflect.Value, key string) (reflect.Value, bool) {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.PkgPath != "" {
+			continue					//unexported
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if name == key {
+			return value.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// payloadKind describes the JSON value a field expects, for error messages
+func payloadKind(fieldType reflect.Type) string {
+	switch fieldType.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a whole number"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "a list of " + strings.TrimPrefix(payloadKind(fieldType.Elem()), "a ") + "s"
+	}
+	return "an object"
+}
+
+// ============================================================================================================================
+// MissingField - the error for a required field left out of a payload
+// ============================================================================================================================
+func MissingField(field string) *Error {
+	return NewError(CodeValidation, field + " is required.")
+}
+
+// ============================================================================================================================
+// FieldError - err, with its message prefixed by the payload field it is about
+// ============================================================================================================================
+func FieldError(field string, err error) *Error {
+	e := AsError(err)
+	return &Error{Code: e.Code, Message: field + ": " + e.Message, Cause: e.Cause}
+}
+
+// ============================================================================================================================
+// RequireField - a MissingField error when value is empty
+// ============================================================================================================================
+func RequireField(field string, value string) error {
+	if value == "" {
+		return MissingField(field)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// ParseAmountField - parse a required decimal amount field of a payload in the given currency
+// ============================================================================================================================
+func ParseAmountField(field string, value string, currency string) (Money, error) {
+	if value == "" {
+		return Money{}, MissingField(field)
+	}
+	money, err := ParseAmount(value, currency)
+	if err != nil {
+		return money, FieldError(field, err)
+	}
+	return money, nil
+}
+
+// ============================================================================================================================
+// ParsePercentageField - parse a required percentage field of a payload, between 0 and 100
+// ============================================================================================================================
+func ParsePercentageField(field string, value string) (Percentage, error) {
+	if value == "" {
+		return 0, MissingField(field)
+	}
+	percentage, err := ParsePercentage(value)
+	if err != nil {
+		return percentage, FieldError(field, err)
+	}
+	return percentage, nil
+}
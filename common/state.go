@@ -0,0 +1,75 @@
+package common
+
+import (
+"encoding/json"
+"errors"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// range of keys covering the whole state of a chaincode
+var FirstKey = ""
+var LastKey = "\xff"
+
+// ResetConfirmation must be given, word for word, to wipe the state of a chaincode
+var ResetConfirmation = "RESET ALL STATE"
+
+// ============================================================================================================================
+// ScanState - call fn with every key/value pair from startKey to endKey, inclusive, in key order
+// ============================================================================================================================
+func ScanState(stub shim.ChaincodeStubInterface, startKey string, endKey string, fn func(key string, value []byte) error) error {
+	iterator, err := stub.RangeQueryState(startKey, endKey)
+	if err != nil {
+		return errors.New("Failed to scan state: " + err.Error())
+	}
+	defer iterator.Close()
+	for iterator.HasNext() {
+		key, value, err := iterator.Next()
+		if err != nil {
+			return errors.New("Failed to scan state: " + err.Error())
+		}
+		err = fn(key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// DecodeState - decode a record read from state into record, leaving record as it is when nothing is stored. A record that
+// is stored but cannot be decoded is an error naming it, never an empty record.
+// ============================================================================================================================
+func DecodeState(valueAsBytes []byte, name string, record interface{}) error {
+	if len(valueAsBytes) == 0 {
+		return nil
+	}
+	err := json.Unmarshal(valueAsBytes, record)
+	if err != nil {
+		return NewError(CodeInternal, name + " cannot be read: " + err.Error())
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// ResetState - delete every key of the chaincode except the ones to keep, returning how many were deleted
+// ============================================================================================================================
+func ResetState(stub shim.ChaincodeStubInterface, keep map[string]bool) (int, error) {
+	keys := []string{}
+	err := ScanState(stub, FirstKey, LastKey, func(key string, value []byte) error {
+		if !keep[key] {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		err = stub.DelState(key)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
@@ -0,0 +1,18 @@
+package common
+
+import (
+"errors"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ============================================================================================================================
+// TxTimestamp - the transaction timestamp in unix seconds. Unlike time.Now() it is the same on every endorsing peer.
+// ============================================================================================================================
+func TxTimestamp(stub shim.ChaincodeStubInterface) (int64, error) {
+	timestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, errors.New("Failed to get transaction timestamp: " + err.Error())
+	}
+	return timestamp.Seconds, nil
+}
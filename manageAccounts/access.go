@@ -0,0 +1,86 @@
+package main
+
+import (
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+// invokePolicy - the roles allowed to call each invoke function. Balance and escrow updates are made by the 'Agreement'
+// chaincode in the name of the agreement party whose transaction triggered them, so they are open to those roles and
+// checked against the accounts involved.
+var invokePolicy = common.Policy{
+	"init": {common.RoleAdmin},
+	"createAccount": {common.RoleAdmin, common.RoleCustomer, common.RoleServiceProvider},
+	"updateAccountBalance": {common.RoleAdmin, common.RoleTreasury, common.RoleCustomer, common.RoleServiceProvider, common.RoleArbiter},
+	"updateCreditLimit": {common.RoleAdmin},
+	"setFxRate": {common.RoleAdmin},
+	"resetState": {common.RoleAdmin},
+	"migrateKeys": {common.RoleAdmin},
+	"rebuildIndexes": {common.RoleAdmin},
+	"holdFunds": {common.RoleAdmin, common.RoleTreasury, common.RoleCustomer},
+	"releaseFunds": {common.RoleAdmin, common.RoleTreasury, common.RoleCustomer, common.RoleServiceProvider, common.RoleArbiter},
+	"returnFunds": {common.RoleAdmin, common.RoleTreasury, common.RoleCustomer, common.RoleServiceProvider, common.RoleArbiter},
+}
+
+// balanceMutations - the functions that move funds between accounts. They are only accepted when the transaction went
+// through one of the allowed caller chaincodes, or comes directly from the treasury.
+var balanceMutations = map[string]bool{
+	"updateAccountBalance": true,
+	"holdFunds": true,
+	"releaseFunds": true,
+	"returnFunds": true,
+}
+
+// queryPolicy - the roles allowed to call each query function. Account level queries are further limited to the owner.
+var queryPolicy = common.Policy{
+	"getAccountByOwner": {common.RoleAdmin, common.RoleCustomer, common.RoleServiceProvider},
+	"getJournal": {common.RoleAdmin, common.RoleCustomer, common.RoleServiceProvider, common.RoleArbiter},
+	"getJournalsByAccount": {common.RoleAdmin, common.RoleCustomer, common.RoleServiceProvider},
+	"reconcileAccount": {common.RoleAdmin, common.RoleCustomer, common.RoleServiceProvider},
+	"getFxRate": {common.RoleAdmin, common.RoleCustomer, common.RoleServiceProvider, common.RoleArbiter},
+	"getHold": {common.RoleAdmin, common.RoleCustomer, common.RoleServiceProvider, common.RoleArbiter},
+	"getHoldsByAccount": {common.RoleAdmin, common.RoleCustomer, common.RoleServiceProvider},
+	"getAllowedCallers": {common.RoleAdmin, common.RoleTreasury},
+	"getAccountHistory": {common.RoleAdmin, common.RoleAuditor, common.RoleCustomer, common.RoleServiceProvider},
+}
+
+// accountNameByRole - the kind of account each role may open for itself
+var accountNameByRole = map[string]string{
+	common.RoleCustomer: common.AccountCustomer,
+	common.RoleServiceProvider: common.AccountServiceProvider,
+}
+
+// ============================================================================================================================
+// authorizeOwner - allow admins and the treasury, arbiters when allowArbiter is set, and callers acting on one of the given
+// accounts
+// ============================================================================================================================
+func authorizeOwner(stub shim.ChaincodeStubInterface, allowArbiter bool, accountOwnerIds ...string) error {
+	caller, err := common.GetIdentity(stub)
+	if err != nil {
+		return err
+	}
+	if caller.HasRole(common.RoleAdmin, common.RoleTreasury) || (allowArbiter && caller.HasRole(common.RoleArbiter)) {
+		return nil
+	}
+	for _, accountOwnerId := range accountOwnerIds {
+		if caller.OwnerId == accountOwnerId {
+			return nil
+		}
+	}
+	return common.NewError(common.CodeUnauthorized, caller.OwnerId + " is not allowed to act on this account.")
+}
+
+// ============================================================================================================================
+// authorizeCallerChaincode - check that a balance mutation came through an allowed caller chaincode, or from the treasury
+// ============================================================================================================================
+func authorizeCallerChaincode(stub shim.ChaincodeStubInterface) error {
+	caller, err := common.GetIdentity(stub)
+	if err != nil {
+		return err
+	}
+	if caller.HasRole(common.RoleTreasury) {
+		return nil
+	}
+	return common.RequireCallerChaincode(stub, "Balance updates")
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+"errors"
+"fmt"
+"encoding/json"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+var HoldObjectType = "hold~agreement"					//holds are stored under the composite key (hold~agreement, agreementId)
+var HoldAccountIndex = "hold~account~agreement"			//index entry (hold~account~agreement, accountOwnerId, agreementId) for each party of a hold
+var HoldPrefix = "_Hold_"				//prefix of the key/value that stored the escrow hold of an agreement before holds had composite keys
+var HoldIndexPrefix = "_HoldIndex_"		//prefix of the key/value that stored the list of agreements an account had holds for
+var EscrowAccount = "_Escrow"			//contra account holding the funds reserved from Customers
+
+// Hold states
+var HoldOpen = "Held"
+var HoldSettled = "Settled"
+
+// Hold is a payment reserved from the Customer for an agreement. The funds leave the Customer's available balance when
+// they are held and are later released to the Service Provider or returned to the Customer, in one go or in parts.
+type Hold struct{
+	AgreementId string `json:"agreementId"`
+	CustomerId string `json:"customerId"`
+	ServiceProviderId string `json:"serviceProviderId"`
+	Amount common.Money `json:"amount"` // still held, in the agreement currency
+	PayerAmount common.Money `json:"payerAmount"` // still held, in the Customer's home currency
+	FxRate string `json:"fxRate,omitempty"` // rate fixed when the funds were held, empty when no conversion was needed
+	Released common.Money `json:"released"` // paid to the Service Provider so far, in the agreement currency
+	Returned common.Money `json:"returned"` // given back to the Customer so far, in the agreement currency
+	Status string `json:"status"`
+	TxId string `json:"txId"` // transaction that held the funds
+}
+
+func holdKey(agreementId string) (string, error) {
+	return common.CreateCompositeKey(HoldObjectType, agreementId)
+}
+
+// ============================================================================================================================
+// holdFunds - reserve a payment of the Customer in escrow for an agreement: the Customer is debited from its home currency
+// into the escrow account and the amount is shown as held on its account until it is released or returned
+// ============================================================================================================================
+func (t *ManageAccount) holdFunds(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	// the arguments are those of common.HoldFundsRequest
+	request, err := common.ParseHoldFundsRequest(args)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	agreementId := request.AgreementId
+	// funds are only held from the Customer accepting the agreement
+	err = authorizeOwner(stub, false, request.CustomerId)
+	if err != nil {
+		return common.RejectSecurity(stub, common.FunctionHoldFunds, err)
+	}
+	amount := request.Amount
+	if !amount.IsPositive() {
+		return common.RaiseError(stub, common.CodeValidation, "Amount held must be positive.")
+	}
+	key, err := holdKey(agreementId)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	holdAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return common.RaiseError(stub, common.CodeInternal, "Failed to get hold for " + agreementId)
+	}
+	if len(holdAsBytes) != 0 {
+		return common.RaiseError(stub, common.CodeConflict, "Funds are already held for agreement " + agreementId + ".")
+	}
+	accounts, err := loadParties(stub, request.CustomerId, request.ServiceProviderId)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	customer := accounts[request.CustomerId]
+	settlement, err := payerSettlement(stub, customer, amount)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	journal, err := newJournal(stub, common.OperationHold, transferEntries(customer.AccountOwnerId, EscrowAccount, settlement.PayerAmount)...)
+	if err != nil {
+		return nil, err
+	}
+	settlement.JournalId = journal.JournalId
+	err = applyJournal(accounts, journal)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	customer.AddHeld(settlement.PayerAmount)
+	err = saveAccounts(stub, customer)
+	if err != nil {
+		return nil, err
+	}
+	err = postJournal(stub, journal)
+	if err != nil {
+		return nil, err
+	}
+	hold := Hold{
+		AgreementId: agreementId,
+		CustomerId: request.CustomerId,
+		ServiceProviderId: request.ServiceProviderId,
+		Amount: amount,
+		PayerAmount: settlement.PayerAmount,
+		FxRate: settlement.FxRate,
+		Released: common.Money{Currency: amount.Currency},
+		Returned: common.Money{Currency: amount.Currency},
+		Status: HoldOpen,
+		TxId: stub.GetTxID(),
+	}
+	err = saveHold(stub, hold)
+	if err != nil {
+		return nil, err
+	}
+	for _, accountOwnerId := range []string{hold.CustomerId, hold.ServiceProviderId} {
+		err = indexHold(stub, accountOwnerId, agreementId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	settlement.Operation = journal.Operation
+	settlement.PayerId = hold.CustomerId
+	settlement.PayeeId = EscrowAccount
+	settlement.AgreementId = agreementId
+	err = common.EmitEvent(stub, common.EventBalanceUpdated, agreementId, settlement.BalanceUpdated())
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Held " + amount.String() + " for agreement " + agreementId)
+	return json.Marshal(settlement)
+}
+
+// ============================================================================================================================
+// releaseFunds - pay the funds held for an agreement, all of them or the given amount, to the Service Provider
+// ============================================================================================================================
+func (t *ManageAccount) releaseFunds(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return t.settleHold(stub, args, true)
+}
+
+// ============================================================================================================================
+// returnFunds - give the funds held for an agreement, all of them or the given amount, back to the Customer
+// ============================================================================================================================
+func (t *ManageAccount) returnFunds(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return t.settleHold(stub, args, false)
+}
+
+// ============================================================================================================================
+// settleHold - take an amount (everything still held when none is given) out of an agreement's hold, paying it to the
+// Service Provider or back to the Customer. A partial amount takes the same share of the Customer's home currency amount,
+// so that the hold is always settled at the rate it was taken at.
+// ============================================================================================================================
+func (t *ManageAccount) settleHold(stub shim.ChaincodeStubInterface, args []string, toServiceProvider bool) ([]byte, error) {
+	// the arguments are those of common.SettleHoldRequest
+	request, err := common.ParseSettleHoldRequest(args, toServiceProvider)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	agreementId := request.AgreementId
+	hold, err := loadHold(stub, agreementId)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	if hold.Status != HoldOpen {
+		return common.RaiseError(stub, common.CodeConflict, "The hold of agreement " + agreementId + " is already settled.")
+	}
+	err = authorizeOwner(stub, true, hold.CustomerId, hold.ServiceProviderId)
+	if err != nil {
+		return common.RejectSecurity(stub, request.Function(), err)
+	}
+	settlement := common.Settlement{Amount: hold.Amount, PayerAmount: hold.PayerAmount, FxRate: hold.FxRate}
+	if request.Amount.Currency != "" {
+		settlement.Amount = request.Amount
+		if settlement.Amount.Currency != hold.Amount.Currency {
+			return common.RaiseError(stub, common.CodeValidation, "Funds are held in " + hold.Amount.Currency + ", not " + settlement.Amount.Currency + ".")
+		}
+		if !settlement.Amount.IsPositive() || settlement.Amount.Amount > hold.Amount.Amount {
+			return common.RaiseError(stub, common.CodeValidation, "Amount must be positive and at most the " + hold.Amount.String() + " still held.")
+		}
+		if settlement.Amount.Amount != hold.Amount.Amount {
+			settlement.PayerAmount, err = hold.PayerAmount.Scale(settlement.Amount.Amount, hold.Amount.Amount)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	accounts, err := loadParties(stub, hold.CustomerId, hold.ServiceProviderId)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	customer := accounts[hold.CustomerId]
+	operation := common.OperationRelease
+	entries := conversionEntries(EscrowAccount, hold.ServiceProviderId, settlement)
+	if !toServiceProvider {
+		operation = common.OperationReturn
+		entries = transferEntries(EscrowAccount, hold.CustomerId, settlement.PayerAmount)
+	}
+	journal, err := newJournal(stub, operation, entries...)
+	if err != nil {
+		return nil, err
+	}
+	settlement.JournalId = journal.JournalId
+	err = applyJournal(accounts, journal)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	customer.AddHeld(settlement.PayerAmount.Neg())
+	err = saveAccounts(stub, customer, accounts[hold.ServiceProviderId])
+	if err != nil {
+		return nil, err
+	}
+	err = postJournal(stub, journal)
+	if err != nil {
+		return nil, err
+	}
+	hold.Amount.Amount = hold.Amount.Amount - settlement.Amount.Amount
+	hold.PayerAmount.Amount = hold.PayerAmount.Amount - settlement.PayerAmount.Amount
+	if toServiceProvider {
+		hold.Released.Amount = hold.Released.Amount + settlement.Amount.Amount
+	}else {
+		hold.Returned.Amount = hold.Returned.Amount + settlement.Amount.Amount
+	}
+	if hold.Amount.IsZero() {
+		hold.Status = HoldSettled
+	}
+	err = saveHold(stub, hold)
+	if err != nil {
+		return nil, err
+	}
+	payeeId := hold.ServiceProviderId
+	if !toServiceProvider {
+		payeeId = hold.CustomerId
+	}
+	settlement.Operation = operation
+	settlement.PayerId = EscrowAccount
+	settlement.PayeeId = payeeId
+	settlement.AgreementId = agreementId
+	err = common.EmitEvent(stub, common.EventBalanceUpdated, agreementId, settlement.BalanceUpdated())
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println(operation + " of " + settlement.Amount.String() + " held for agreement " + agreementId)
+	return json.Marshal(settlement)
+}
+
+// ============================================================================================================================
+// loadHold - fetch the escrow hold of an agreement
+// ============================================================================================================================
+func loadHold(stub shim.ChaincodeStubInterface, agreementId string) (Hold, error) {
+	hold := Hold{}
+	key, err := holdKey(agreementId)
+	if err != nil {
+		return hold, err
+	}
+	holdAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return hold, errors.New("Failed to get hold for " + agreementId)
+	}
+	if len(holdAsBytes) == 0 {
+		return hold, common.NewError(common.CodeNotFound, "No funds are held for agreement " + agreementId + ".")
+	}
+	err = json.Unmarshal(holdAsBytes, &hold)
+	return hold, err
+}
+
+// ============================================================================================================================
+// saveHold - store the escrow hold of an agreement
+// ============================================================================================================================
+func saveHold(stub shim.ChaincodeStubInterface, hold Hold) error {
+	holdAsBytes, err := json.Marshal(hold)
+	if err != nil {
+		return err
+	}
+	key, err := holdKey(hold.AgreementId)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, holdAsBytes)
+}
+
+// ============================================================================================================================
+// indexHold - add an index entry listing the hold of an agreement under an account. Each entry is its own key, so holds
+// of different agreements never write to the same key.
+// ============================================================================================================================
+func indexHold(stub shim.ChaincodeStubInterface, accountOwnerId string, agreementId string) error {
+	key, err := common.CreateCompositeKey(HoldAccountIndex, accountOwnerId, agreementId)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, []byte{0x00})
+}
+
+// ============================================================================================================================
+// getHold - fetch the funds held for an agreement
+// ============================================================================================================================
+func (t *ManageAccount) getHold(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return common.RaiseError(stub, common.CodeValidation, "Incorrect number of arguments. Expecting \"Agreement Id\" as an argument.")
+	}
+	hold, err := loadHold(stub, args[0])
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	err = authorizeOwner(stub, true, hold.CustomerId, hold.ServiceProviderId)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	return json.Marshal(hold)
+}
+
+// ============================================================================================================================
+// getHoldsByAccount - fetch the holds of every agreement an account is party to, along with its available and held balances
+// ============================================================================================================================
+func (t *ManageAccount) getHoldsByAccount(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return common.RaiseError(stub, common.CodeValidation, "Incorrect number of arguments. Expecting \"Account Owner Id\" as an argument.")
+	}
+	accountOwnerId := args[0]
+	err := authorizeOwner(stub, false, accountOwnerId)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	accountAsBytes, err := getAccountState(stub, accountOwnerId)
+	if err != nil {
+		return common.RaiseError(stub, common.CodeInternal, "Failed to get state for " + accountOwnerId)
+	}
+	account := common.Account{}
+	err = common.DecodeState(accountAsBytes, "Account " + accountOwnerId, &account)
+	if err != nil {
+		return nil, err
+	}
+	if account.AccountOwnerId != accountOwnerId {
+		return common.RaiseError(stub, common.CodeNotFound, accountOwnerId + " not Found.")
+	}
+	holds := []Hold{}
+	err = common.ScanPartialCompositeKey(stub, HoldAccountIndex, []string{accountOwnerId}, func(key string, attributes []string, value []byte) error {
+		hold, err := loadHold(stub, attributes[1])
+		if err != nil {
+			return err
+		}
+		holds = append(holds, hold)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]interface{}{
+		"accountOwnerId": accountOwnerId,
+		"available": account.Balances,
+		"held": account.Held,
+		"holds": holds,
+	}
+	return json.Marshal(result)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+"encoding/json"
+"testing"
+
+"github.com/golang/protobuf/ptypes/timestamp"
+"github.com/hyperledger/fabric/core/chaincode/shim"
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+// stateStub keeps the chaincode state in memory and calls in as an admin. Any other stub function is not expected.
+type stateStub struct{
+	shim.ChaincodeStubInterface
+	state map[string][]byte
+}
+
+func (stub *stateStub) GetState(key string) ([]byte, error) {
+	return stub.state[key], nil
+}
+
+func (stub *stateStub) PutState(key string, value []byte) error {
+	stub.state[key] = value
+	return nil
+}
+
+func (stub *stateStub) DelState(key string) error {
+	delete(stub.state, key)
+	return nil
+}
+
+func (stub *stateStub) GetTxID() string {
+	return "tx1"
+}
+
+func (stub *stateStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: 1500000000}, nil
+}
+
+func (stub *stateStub) ReadCertAttribute(attributeName string) ([]byte, error) {
+	attributes := map[string]string{common.OwnerIdAttribute: "admin", common.RoleAttribute: common.RoleAdmin, common.OrganizationAttribute: "Office Depot"}
+	return []byte(attributes[attributeName]), nil
+}
+
+func (stub *stateStub) SetEvent(name string, payload []byte) error {
+	return nil
+}
+
+// heldStub - a Customer keeping EUR and a Service Provider keeping USD, with 100.00 USD of agreement SA1 held from the
+// Customer as 90.00 EUR
+func heldStub(t *testing.T) *stateStub {
+	stub := &stateStub{state: map[string][]byte{}}
+	customer := &common.Account{AccountOwnerId: "C1", AccountName: common.AccountCustomer, Currency: "EUR",
+		Balances: map[string]common.Money{"EUR": money(1000, "EUR")}, Held: map[string]common.Money{"EUR": money(9000, "EUR")}}
+	provider := &common.Account{AccountOwnerId: "S1", AccountName: common.AccountServiceProvider, Currency: "USD",
+		Balances: map[string]common.Money{"USD": money(0, "USD")}}
+	err := saveAccounts(stub, customer, provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = saveHold(stub, Hold{AgreementId: "SA1", CustomerId: "C1", ServiceProviderId: "S1", Amount: money(10000, "USD"),
+		PayerAmount: money(9000, "EUR"), FxRate: "0.9", Released: money(0, "USD"), Returned: money(0, "USD"), Status: HoldOpen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stub
+}
+
+func loadAccount(t *testing.T, stub *stateStub, accountOwnerId string) common.Account {
+	account := common.Account{}
+	accountAsBytes, _ := getAccountState(stub, accountOwnerId)
+	err := json.Unmarshal(accountAsBytes, &account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return account
+}
+
+func TestSettleHold(t *testing.T) {
+	cases := []struct{
+		name string
+		amount string // empty to settle everything held
+		toServiceProvider bool
+		payerAmount int64 // EUR cents taken out of the hold
+		holdLeft int64 // USD cents still held
+		status string
+		customerEUR int64
+		providerUSD int64
+	}{
+		{"full release", "", true, 9000, 0, HoldSettled, 1000, 10000},
+		{"partial release scales the payer amount", "25.00 USD", true, 2250, 7500, HoldOpen, 1000, 2500},
+		{"partial release rounds the payer amount", "33.33 USD", true, 3000, 6667, HoldOpen, 1000, 3333},
+		{"partial return", "40.00 USD", false, 3600, 6000, HoldOpen, 4600, 0},
+		{"full return", "", false, 9000, 0, HoldSettled, 10000, 0},
+	}
+	for _, c := range cases {
+		stub := heldStub(t)
+		args := []string{"SA1"}
+		if c.amount != "" {
+			args = append(args, c.amount)
+		}
+		settlementAsBytes, err := (&ManageAccount{}).settleHold(common.RecordEvents(stub), args, c.toServiceProvider)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		settlement := common.Settlement{}
+		err = json.Unmarshal(settlementAsBytes, &settlement)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if settlement.PayerAmount != money(c.payerAmount, "EUR") {
+			t.Errorf("%s: payer amount %v, want %d EUR cents", c.name, settlement.PayerAmount, c.payerAmount)
+		}
+		hold, err := loadHold(stub, "SA1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hold.Amount.Amount != c.holdLeft || hold.PayerAmount.Amount != 9000 - c.payerAmount || hold.Status != c.status {
+			t.Errorf("%s: hold %v / %v %s, want %d USD cents still held, %s", c.name, hold.Amount, hold.PayerAmount, hold.Status, c.holdLeft, c.status)
+		}
+		customer := loadAccount(t, stub, "C1")
+		if customer.Balance("EUR").Amount != c.customerEUR || customer.Held["EUR"].Amount != 9000 - c.payerAmount {
+			t.Errorf("%s: customer balance %v held %v, want %d EUR cents with %d held", c.name, customer.Balances, customer.Held, c.customerEUR, 9000 - c.payerAmount)
+		}
+		provider := loadAccount(t, stub, "S1")
+		if provider.Balance("USD").Amount != c.providerUSD {
+			t.Errorf("%s: provider balance %v, want %d USD cents", c.name, provider.Balances, c.providerUSD)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+"errors"
+"fmt"
+"encoding/json"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+var FxRatePrefix = "_FxRate_"	//prefix of the key/value that stores the rate of a currency pair
+
+// FxRate is one row of the FX rate table: units of ToCurrency paid for one unit of FromCurrency
+type FxRate struct{
+	FromCurrency string `json:"fromCurrency"`
+	ToCurrency string `json:"toCurrency"`
+	Rate string `json:"rate"`
+	TxId string `json:"txId"` // transaction that last set the rate
+}
+
+// fxRateRequest is the JSON argument of setFxRate
+type fxRateRequest struct{
+	FromCurrency string `json:"fromCurrency"`
+	ToCurrency string `json:"toCurrency"`
+	Rate string `json:"rate"` // decimal, e.g. "0.92150000"
+}
+
+func fxRateKey(fromCurrency string, toCurrency string) string {
+	return FxRatePrefix + fromCurrency + "_" + toCurrency
+}
+
+// ============================================================================================================================
+// setFxRate - admin function to set the rate used to convert fromCurrency amounts into toCurrency
+// ============================================================================================================================
+func (t *ManageAccount) setFxRate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	request := fxRateRequest{}
+	err := common.DecodePayload(args, "FX rate", &request)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	fromCurrency, toCurrency := request.FromCurrency, request.ToCurrency
+	if fromCurrency == "" {
+		return common.Raise(stub, common.MissingField("fromCurrency"))
+	}
+	if toCurrency == "" {
+		return common.Raise(stub, common.MissingField("toCurrency"))
+	}
+	for _, currency := range []string{fromCurrency, toCurrency} {
+		if _, err := common.Digits(currency); err != nil {
+			return common.Raise(stub, err)
+		}
+	}
+	if fromCurrency == toCurrency {
+		return common.RaiseError(stub, common.CodeValidation, "fromCurrency and toCurrency must be different.")
+	}
+	err = common.RequireField("rate", request.Rate)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	rate, err := common.ParseRate(request.Rate)
+	if err != nil {
+		return common.Raise(stub, common.FieldError("rate", err))
+	}
+	fxRate := FxRate{fromCurrency, toCurrency, rate.String(), stub.GetTxID()}
+	fxRateAsBytes, err := json.Marshal(fxRate)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(fxRateKey(fromCurrency, toCurrency), fxRateAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	err = common.EmitEvent(stub, common.EventFxRateSet, "", &common.FxRateSet{FromCurrency: fromCurrency, ToCurrency: toCurrency, Rate: fxRate.Rate})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("FX rate " + fromCurrency + "/" + toCurrency + " set to " + fxRate.Rate)
+	return nil, nil
+}
+
+// ============================================================================================================================
+// getFxRate - fetch the rate of a currency pair
+// ============================================================================================================================
+func (t *ManageAccount) getFxRate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return common.RaiseError(stub, common.CodeValidation, "Incorrect number of arguments. Expecting From Currency and To Currency as arguments.")
+	}
+	fxRateAsBytes, err := stub.GetState(fxRateKey(args[0], args[1]))
+	if err != nil || len(fxRateAsBytes) == 0 {
+		return common.RaiseError(stub, common.CodeNotFound, "No FX rate from " + args[0] + " to " + args[1] + ".")
+	}
+	return fxRateAsBytes, nil
+}
+
+// ============================================================================================================================
+// lookupFxRate - the rate to convert fromCurrency amounts into toCurrency
+// ============================================================================================================================
+func lookupFxRate(stub shim.ChaincodeStubInterface, fromCurrency string, toCurrency string) (common.Rate, error) {
+	fxRateAsBytes, err := stub.GetState(fxRateKey(fromCurrency, toCurrency))
+	if err != nil {
+		return 0, errors.New("Failed to get FX rate from " + fromCurrency + " to " + toCurrency)
+	}
+	if len(fxRateAsBytes) == 0 {
+		return 0, common.NewError(common.CodeNotFound, "No FX rate from " + fromCurrency + " to " + toCurrency + ".")
+	}
+	fxRate := FxRate{}
+	err = common.DecodeState(fxRateAsBytes, "FX rate from " + fromCurrency + " to " + toCurrency, &fxRate)
+	if err != nil {
+		return 0, err
+	}
+	return common.ParseRate(fxRate.Rate)
+}
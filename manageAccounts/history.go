@@ -0,0 +1,43 @@
+package main
+
+import (
+"fmt"
+"encoding/json"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+// ============================================================================================================================
+// getAccountHistory - fetch every version of an account with the transaction, time and identity that stored it and the
+// fields it changed. Auditors can read the history of any account, everyone else only of their own.
+// ============================================================================================================================
+func (t *ManageAccount) getAccountHistory(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return common.RaiseError(stub, common.CodeValidation, "Incorrect number of arguments. Expecting \"Account Owner Id\" as an argument.")
+	}
+	accountOwnerId := args[0]
+	caller, err := common.GetIdentity(stub)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	if !caller.HasRole(common.RoleAuditor) {
+		err = authorizeOwner(stub, false, accountOwnerId)
+		if err != nil {
+			return common.RejectUnauthorized(stub, err.Error())
+		}
+	}
+	accountAsBytes, err := getAccountState(stub, accountOwnerId)
+	if err != nil {
+		return common.RaiseError(stub, common.CodeInternal, "Failed to get state for " + accountOwnerId)
+	}
+	history, err := common.GetHistory(stub, AccountObjectType, accountOwnerId)
+	if err != nil {
+		return nil, err
+	}
+	if len(accountAsBytes) == 0 && len(history) == 0 {
+		return common.RaiseError(stub, common.CodeNotFound, accountOwnerId + " not Found.")
+	}
+	fmt.Println("Fetched the history of account " + accountOwnerId)
+	return json.Marshal(map[string]interface{}{"accountOwnerId": accountOwnerId, "history": history})
+}
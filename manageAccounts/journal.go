@@ -0,0 +1,269 @@
+package main
+
+import (
+"errors"
+"fmt"
+"encoding/json"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+var JournalObjectType = "journal~id"					//journals are stored under the composite key (journal~id, journalId)
+var JournalAccountIndex = "journal~account~id"			//index entry (journal~account~id, accountOwnerId, journalId) for each account a journal is posted against
+var JournalIndexPrefix = "_JournalIndex_"		//prefix of the key/value that stored the list of journals posted against an account before journals had composite keys
+var OpeningBalanceAccount = "_OpeningBalance"	//contra account used to balance the opening balance of new accounts
+var FxClearingAccount = "_FxClearing"			//contra account through which currency conversions pass
+
+// JournalEntry is one line of a journal: a debit or a credit against a single account.
+// A debit decreases the account balance, a credit increases it. Both are in the same currency.
+type JournalEntry struct{
+	AccountOwnerId string `json:"accountOwnerId"`
+	Debit common.Money `json:"debit"`
+	Credit common.Money `json:"credit"`
+}
+
+// Journal groups the balanced entries posted by one balance change.
+type Journal struct{
+	JournalId string `json:"journalId"`
+	TxId string `json:"txId"`
+	Operation string `json:"operation"`
+	Entries []JournalEntry `json:"entries"`
+}
+
+// ============================================================================================================================
+// newJournal - build a journal for the given entries under the next journal Id of this transaction
+// ============================================================================================================================
+func newJournal(stub shim.ChaincodeStubInterface, operation string, entries ...JournalEntry) (Journal, error) {
+	journalId, err := common.NewID(stub, "JN", JournalObjectType)	//one journal per transaction, suffixed when a transaction posts several
+	if err != nil {
+		return Journal{}, err
+	}
+	return Journal{journalId, stub.GetTxID(), operation, entries}, nil
+}
+
+// ============================================================================================================================
+// transferEntries - the pair of entries moving amount from the payer account to the payee account
+// ============================================================================================================================
+func transferEntries(payer string, payee string, amount common.Money) []JournalEntry {
+	zero := common.Money{Currency: amount.Currency}
+	return []JournalEntry{
+		JournalEntry{payer, amount, zero},
+		JournalEntry{payee, zero, amount},
+	}
+}
+
+// ============================================================================================================================
+// postJournal - check that debits equal credits in every currency and store the journal along with the per account index
+// ============================================================================================================================
+func postJournal(stub shim.ChaincodeStubInterface, journal Journal) error {
+	balance := make(map[string]int64)
+	for _, entry := range journal.Entries {
+		if entry.Debit.Currency != entry.Credit.Currency {
+			return common.NewError(common.CodeInternal, "Journal " + journal.JournalId + " mixes currencies within an entry.")
+		}
+		balance[entry.Debit.Currency] = balance[entry.Debit.Currency] + entry.Debit.Amount - entry.Credit.Amount
+	}
+	for _, difference := range balance {
+		if difference != 0 {
+			return common.NewError(common.CodeInternal, "Journal " + journal.JournalId + " is not balanced.")
+		}
+	}
+	err := putJournalState(stub, journal)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Journal posted: " + journal.JournalId)
+	return nil
+}
+
+// ============================================================================================================================
+// putJournalState - store a journal under its journal~id composite key and index it under its accounts. Journals are never
+// changed once posted, so they keep no history.
+// ============================================================================================================================
+func putJournalState(stub shim.ChaincodeStubInterface, journal Journal) error {
+	journalAsBytes, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	key, err := common.CreateCompositeKey(JournalObjectType, journal.JournalId)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(key, journalAsBytes)
+	if err != nil {
+		return err
+	}
+	return indexJournal(stub, journal)
+}
+
+// ============================================================================================================================
+// indexJournal - add an index entry listing the journal under every account it is posted against
+// ============================================================================================================================
+func indexJournal(stub shim.ChaincodeStubInterface, journal Journal) error {
+	for _, entry := range journal.Entries {
+		key, err := common.CreateCompositeKey(JournalAccountIndex, entry.AccountOwnerId, journal.JournalId)
+		if err != nil {
+			return err
+		}
+		err = stub.PutState(key, []byte{0x00})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// getJournalState - fetch a stored journal by its Id, empty when there is none
+// ============================================================================================================================
+func getJournalState(stub shim.ChaincodeStubInterface, journalId string) ([]byte, error) {
+	key, err := common.CreateCompositeKey(JournalObjectType, journalId)
+	if err != nil {
+		return nil, err
+	}
+	return stub.GetState(key)
+}
+
+// ============================================================================================================================
+// getJournalsForAccount - fetch every journal posted against an account, in journal Id order
+// ============================================================================================================================
+func getJournalsForAccount(stub shim.ChaincodeStubInterface, accountOwnerId string) ([]Journal, error) {
+	journals := []Journal{}
+	err := common.ScanPartialCompositeKey(stub, JournalAccountIndex, []string{accountOwnerId}, func(key string, attributes []string, value []byte) error {
+		journalId := attributes[1]
+		journalAsBytes, err := getJournalState(stub, journalId)
+		if err != nil {
+			return errors.New("Failed to get state for " + journalId)
+		}
+		journal := Journal{}
+		err = common.DecodeState(journalAsBytes, "Journal " + journalId, &journal)
+		if err != nil {
+			return err
+		}
+		journals = append(journals, journal)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return journals, nil
+}
+
+// ============================================================================================================================
+// applyEntry - the balance after crediting and debiting it with a journal entry
+// ============================================================================================================================
+func applyEntry(balance common.Money, entry JournalEntry) (common.Money, error) {
+	balance, err := balance.Add(entry.Credit)
+	if err != nil {
+		return balance, err
+	}
+	return balance.Sub(entry.Debit)
+}
+
+// ============================================================================================================================
+// getJournal - fetch a single journal by its Id
+// ============================================================================================================================
+func (t *ManageAccount) getJournal(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return common.RaiseError(stub, common.CodeValidation, "Incorrect number of arguments. Expecting \"Journal Id\" as an argument.")
+	}
+	journalAsBytes, err := getJournalState(stub, args[0])
+	if err != nil || len(journalAsBytes) == 0 {
+		return common.RaiseError(stub, common.CodeNotFound, args[0] + " not Found.")
+	}
+	// a journal can be read by the owners of the accounts it was posted against
+	journal := Journal{}
+	err = common.DecodeState(journalAsBytes, "Journal " + args[0], &journal)
+	if err != nil {
+		return nil, err
+	}
+	accountOwnerIds := []string{}
+	for _, entry := range journal.Entries {
+		accountOwnerIds = append(accountOwnerIds, entry.AccountOwnerId)
+	}
+	err = authorizeOwner(stub, true, accountOwnerIds...)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	return journalAsBytes, nil
+}
+
+// ============================================================================================================================
+// getJournalsByAccount - fetch the line item trail of an account
+// ============================================================================================================================
+func (t *ManageAccount) getJournalsByAccount(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return common.RaiseError(stub, common.CodeValidation, "Incorrect number of arguments. Expecting \"Account Owner Id\" as an argument.")
+	}
+	err := authorizeOwner(stub, false, args[0])
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	journals, err := getJournalsForAccount(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(journals)
+}
+
+// ============================================================================================================================
+// reconcileAccount - compare the stored Account balance with the balance derived from its journals
+// ============================================================================================================================
+func (t *ManageAccount) reconcileAccount(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return common.RaiseError(stub, common.CodeValidation, "Incorrect number of arguments. Expecting \"Account Owner Id\" as an argument.")
+	}
+	accountOwnerId := args[0]
+	err := authorizeOwner(stub, false, accountOwnerId)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	accountAsBytes, err := getAccountState(stub, accountOwnerId)
+	if err != nil {
+		return common.RaiseError(stub, common.CodeInternal, "Failed to get state for " + accountOwnerId)
+	}
+	account := common.Account{}
+	err = common.DecodeState(accountAsBytes, "Account " + accountOwnerId, &account)
+	if err != nil {
+		return nil, err
+	}
+	if account.AccountOwnerId != accountOwnerId {
+		return common.RaiseError(stub, common.CodeNotFound, accountOwnerId + " not Found.")
+	}
+	journals, err := getJournalsForAccount(stub, accountOwnerId)
+	if err != nil {
+		return nil, err
+	}
+	journalBalances := make(map[string]common.Money)
+	for _, journal := range journals {
+		for _, entry := range journal.Entries {
+			if entry.AccountOwnerId == accountOwnerId {
+				balance := journalBalances[entry.Credit.Currency]
+				balance.Currency = entry.Credit.Currency
+				journalBalances[balance.Currency], err = applyEntry(balance, entry)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	reconciled := true
+	for currency, balance := range account.Balances {
+		if journalBalances[currency].Amount != balance.Amount {
+			reconciled = false
+		}
+	}
+	for currency, balance := range journalBalances {
+		if account.Balance(currency).Amount != balance.Amount {
+			reconciled = false
+		}
+	}
+	result := map[string]interface{}{
+		"accountOwnerId": accountOwnerId,
+		"balances": account.Balances,
+		"journalBalances": journalBalances,
+		"reconciled": reconciled,
+	}
+	return json.Marshal(result)
+}
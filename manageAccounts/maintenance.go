@@ -0,0 +1,231 @@
+package main
+
+import (
+"errors"
+"fmt"
+"strconv"
+"strings"
+"encoding/json"
+
+"github.com/hyperledger/fabric/core/chaincode/shim"
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+// ============================================================================================================================
+// resetState - admin function for test networks to delete every account, journal, hold and rate. The registered caller
+// chaincodes are kept. The caller must pass common.ResetConfirmation to show it means it.
+// ============================================================================================================================
+func (t *ManageAccount) resetState(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 || args[0] != common.ResetConfirmation {
+		return common.RaiseError(stub, common.CodeValidation, "Resetting deletes every account. Pass \"" + common.ResetConfirmation + "\" to confirm.")
+	}
+	deleted, err := common.ResetState(stub, map[string]bool{common.AllowedCallersKey: true})
+	if err != nil {
+		return nil, err
+	}
+	err = common.EmitEvent(stub, common.EventAdminActionPerformed, "", &common.AdminActionPerformed{
+		Chaincode: "ManageAccount",
+		Action: "resetState",
+		Details: map[string]string{"keysDeleted": strconv.Itoa(deleted)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("ManageAccount state reset, " + strconv.Itoa(deleted) + " keys deleted")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// migrateKeys - admin function moving the accounts, journals and holds of the earlier key layout to their composite keys,
+// then deleting the JSON array indexes that listed them. Every plain key is looked at, so that records missing from those
+// indexes are moved too. Running it again once everything was moved does nothing.
+// ============================================================================================================================
+func (t *ManageAccount) migrateKeys(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	keys, err := common.ListPlainKeys(stub)
+	if err != nil {
+		return nil, err
+	}
+	migrated := 0
+	for _, key := range keys {
+		moved := false
+		if key == AccountIndexStr || strings.HasPrefix(key, JournalIndexPrefix) || strings.HasPrefix(key, HoldIndexPrefix) {
+			err = stub.DelState(key)							//replaced by the composite key indexes
+		}else if strings.HasPrefix(key, HoldPrefix) {
+			moved, err = migrateHold(stub, strings.TrimPrefix(key, HoldPrefix))
+		}else {
+			moved, err = migrateRecord(stub, key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if moved {
+			migrated++
+		}
+	}
+	err = common.EmitEvent(stub, common.EventAdminActionPerformed, "", &common.AdminActionPerformed{
+		Chaincode: "ManageAccount",
+		Action: "migrateKeys",
+		Details: map[string]string{"recordsMigrated": strconv.Itoa(migrated)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println(strconv.Itoa(migrated) + " records moved to composite keys")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// migrateRecord - move the account or journal stored under a plain key to its composite key. Other plain keys, such as the
+// registered caller chaincodes and the FX rates, are settings and stay where they are. Like every migration, records are
+// decoded and stored again in their current format through the same function that stores them day to day, so that
+// accounts get a first history entry.
+// ============================================================================================================================
+func migrateRecord(stub shim.ChaincodeStubInterface, key string) (bool, error) {
+	valueAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return false, errors.New("Failed to get state for " + key)
+	}
+	record := struct{
+		AccountOwnerId string `json:"accountOwnerId"`
+		JournalId string `json:"journalId"`
+	}{}
+	if len(valueAsBytes) == 0 || json.Unmarshal(valueAsBytes, &record) != nil {
+		return false, nil
+	}
+	if record.AccountOwnerId == key {
+		account := common.Account{}
+		err = json.Unmarshal(valueAsBytes, &account)
+		if err != nil {
+			return false, errors.New("Account " + key + " cannot be read: " + err.Error())
+		}
+		accountAsBytes, err := json.Marshal(account)
+		if err != nil {
+			return false, err
+		}
+		err = putAccountState(stub, key, accountAsBytes)
+		if err != nil {
+			return false, err
+		}
+		return true, stub.DelState(key)
+	}
+	if record.JournalId == key {
+		journal := Journal{}
+		err = json.Unmarshal(valueAsBytes, &journal)
+		if err != nil {
+			return false, errors.New("Journal " + key + " cannot be read: " + err.Error())
+		}
+		err = putJournalState(stub, journal)
+		if err != nil {
+			return false, err
+		}
+		return true, stub.DelState(key)
+	}
+	return false, nil
+}
+
+// ============================================================================================================================
+// migrateHold - move the escrow hold of an agreement to its composite key and index it under both parties
+// ============================================================================================================================
+func migrateHold(stub shim.ChaincodeStubInterface, agreementId string) (bool, error) {
+	oldKey := HoldPrefix + agreementId
+	holdAsBytes, err := stub.GetState(oldKey)
+	if err != nil {
+		return false, errors.New("Failed to get state for " + oldKey)
+	}
+	if len(holdAsBytes) == 0 {
+		return false, nil
+	}
+	hold := Hold{}
+	err = json.Unmarshal(holdAsBytes, &hold)
+	if err != nil {
+		return false, errors.New("Hold of " + agreementId + " cannot be read: " + err.Error())
+	}
+	hold.AgreementId = agreementId
+	err = saveHold(stub, hold)
+	if err != nil {
+		return false, err
+	}
+	err = stub.DelState(oldKey)
+	if err != nil {
+		return false, err
+	}
+	return true, indexHoldParties(stub, hold)
+}
+
+// ============================================================================================================================
+// indexHoldParties - index the hold of an agreement under both its parties
+// ============================================================================================================================
+func indexHoldParties(stub shim.ChaincodeStubInterface, hold Hold) error {
+	for _, accountOwnerId := range []string{hold.CustomerId, hold.ServiceProviderId} {
+		err := indexHold(stub, accountOwnerId, hold.AgreementId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// rebuildIndexes - admin function that drops the journal~account~id and hold~account~agreement indexes and writes them
+// again from the stored journals and holds, e.g. after an index entry was lost or written for the wrong account
+// ============================================================================================================================
+func (t *ManageAccount) rebuildIndexes(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	_, err := common.DeleteCompositeKeys(stub, JournalAccountIndex)
+	if err != nil {
+		return nil, err
+	}
+	_, err = common.DeleteCompositeKeys(stub, HoldAccountIndex)
+	if err != nil {
+		return nil, err
+	}
+	journals := []Journal{}
+	err = common.ScanPartialCompositeKey(stub, JournalObjectType, []string{}, func(key string, attributes []string, valueAsBytes []byte) error {
+		journal := Journal{}
+		err := common.DecodeState(valueAsBytes, "Journal " + attributes[0], &journal)
+		if err != nil {
+			return err
+		}
+		journals = append(journals, journal)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	holds := []Hold{}
+	err = common.ScanPartialCompositeKey(stub, HoldObjectType, []string{}, func(key string, attributes []string, valueAsBytes []byte) error {
+		hold := Hold{}
+		err := common.DecodeState(valueAsBytes, "Hold of " + attributes[0], &hold)
+		if err != nil {
+			return err
+		}
+		hold.AgreementId = attributes[0]
+		holds = append(holds, hold)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the indexes are written once the scans are done, so that no scan sees its own writes
+	for _, journal := range journals {
+		err = indexJournal(stub, journal)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, hold := range holds {
+		err = indexHoldParties(stub, hold)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = common.EmitEvent(stub, common.EventAdminActionPerformed, "", &common.AdminActionPerformed{
+		Chaincode: "ManageAccount",
+		Action: "rebuildIndexes",
+		Details: map[string]string{"journalsIndexed": strconv.Itoa(len(journals)), "holdsIndexed": strconv.Itoa(len(holds))},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Account indexes rebuilt from " + strconv.Itoa(len(journals)) + " journals and " + strconv.Itoa(len(holds)) + " holds")
+	return nil, nil
+}
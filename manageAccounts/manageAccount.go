@@ -22,12 +22,13 @@ package main
 import (
 "errors"
 "fmt"
-"strconv"
+"sort"
+"strings"
 "encoding/json"
 	//"time"
-	//"strings"
 
 "github.com/hyperledger/fabric/core/chaincode/shim"
+"github.com/Dimple-Kanwar/Office-Depot/common"
 )
 
 // ManageAccount example simple Chaincode implementation
@@ -35,13 +36,9 @@ type ManageAccount struct {
 }
 
 
-var AccountIndexStr = "_AccountIndex"	//name for the key/value that will store a list of all known accounts
+var AccountObjectType = "account~owner"	//accounts are stored under the composite key (account~owner, accountOwnerId)
+var AccountIndexStr = "_AccountIndex"	//name for the key/value that stored a list of all known accounts before they had composite keys
 
-type Account struct{
-	AccountOwnerId string `json:"accountOwnerId"` 
-	AccountName string `json:"accountName"` // Customer or Service Provider
-	AccountBalance float64 `json:"accountBalance"`
-}
 // ============================================================================================================================
 // Main
 // ============================================================================================================================
@@ -55,21 +52,38 @@ func main() {
 // ============================================================================================================================
 // Init - reset all the things
 // ============================================================================================================================
-func (t *ManageAccount) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	var err error
-
-	// Initialize the chaincode
-	
-	fmt.Println("ManageAccount chaincode is deployed successfully.")
+func (t *ManageAccount) Init(stub shim.ChaincodeStubInterface, function string, args []string) (result []byte, err error) {
+	// the events of a call that succeeded are set together as one event
+	recorder := common.RecordEvents(stub)
+	stub = recorder
+	defer func() {
+		if err == nil {
+			err = recorder.Publish("init")
+		}
+		if err != nil {
+			err = common.AsError(err)
+		}
+	}()
 
-	var empty []string
-	jsonAsBytes, _ := json.Marshal(empty)								//marshal an emtpy array of strings to clear the index
-	err = stub.PutState(AccountIndexStr, jsonAsBytes)
+	// Initialize the chaincode, which only an admin may do
+	_, err = common.RequireRole(stub, common.RoleAdmin)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	// the Init arguments are the names of the chaincodes allowed to move funds, i.e. the deployed 'Agreement' chaincode.
+	// An upgrade without arguments keeps the names already registered.
+	allowedCallers, err := common.RegisterAllowedCallers(stub, args)
 	if err != nil {
 		return nil, err
 	}
-	tosend := "{ \"message\" : \"ManageAccount chaincode is deployed successfully.\", \"code\" : \"200\"}"
-	err = stub.SetEvent("evtsender", []byte(tosend))
+
+	fmt.Println("ManageAccount chaincode is deployed successfully.")
+
+	err = common.EmitEvent(stub, common.EventAdminActionPerformed, "", &common.AdminActionPerformed{
+		Chaincode: "ManageAccount",
+		Action: "init",
+		Details: map[string]string{"allowedCallers": strings.Join(allowedCallers, ",")},
+	})
 	if err != nil {
 		return nil, err
 	} 
@@ -87,45 +101,117 @@ func (t *ManageAccount) Run(stub shim.ChaincodeStubInterface, function string, a
 // ============================================================================================================================
 // Invoke - Our entry point for Invocations
 // ============================================================================================================================
-func (t *ManageAccount) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+func (t *ManageAccount) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) (result []byte, err error) {
+	// every failure reaches the caller as a common.Error with its code, the events of a call that succeeded are set
+	// together as one event
+	recorder := common.RecordEvents(stub)
+	stub = recorder
+	defer func() {
+		if err == nil {
+			err = recorder.Publish(function)
+		}
+		if err != nil {
+			err = common.AsError(err)
+		}
+	}()
 	fmt.Println("invoke is running " + function)
 
+	// only the roles in the invoke policy may call a function, and functions missing from it cannot be called
+	_, err = invokePolicy.Authorize(stub, function)
+	if err != nil {
+		if balanceMutations[function] {
+			return common.RejectSecurity(stub, function, err)
+		}
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	// funds only move through the registered agreement chaincode
+	if balanceMutations[function] {
+		err := authorizeCallerChaincode(stub)
+		if err != nil {
+			return common.RejectSecurity(stub, function, err)
+		}
+	}
+
 	// Handle different functions
-	if function == "init" {													//initialize the chaincode state, used as reset
+	if function == "init" {													//initialize the chaincode state, existing data is kept
 		return t.Init(stub, "init", args)
 	}else if function == "createAccount" {											//writes a value to the chaincode state
 		return t.createAccount(stub, args)
-	}else if function == "updateAccountBalance" {									//create a new payment
+	}else if function == common.FunctionUpdateAccountBalance {									//create a new payment
 		return t.updateAccountBalance(stub, args)
+	}else if function == "updateCreditLimit" {									//admin: change the credit limit of an account
+		return t.updateCreditLimit(stub, args)
+	}else if function == "setFxRate" {											//admin: maintain the FX rate table
+		return t.setFxRate(stub, args)
+	}else if function == common.FunctionHoldFunds {											//reserve a Customer payment in escrow
+		return t.holdFunds(stub, args)
+	}else if function == common.FunctionReleaseFunds {										//pay held funds to the Service Provider
+		return t.releaseFunds(stub, args)
+	}else if function == common.FunctionReturnFunds {										//give held funds back to the Customer
+		return t.returnFunds(stub, args)
+	}else if function == "resetState" {											//admin: wipe all accounts on a test network
+		return t.resetState(stub, args)
+	}else if function == "migrateKeys" {										//admin: move records from the array indexes to composite keys
+		return t.migrateKeys(stub, args)
+	}else if function == "rebuildIndexes" {										//admin: write the journal and hold indexes again
+		return t.rebuildIndexes(stub, args)
 	}
 	fmt.Println("invoke did not find func: " + function)					//error
 
-	errMsg := "{ \"message\" : \"Received unknown function invocation\", \"code\" : \"503\"}"
-	err := stub.SetEvent("errEvent", []byte(errMsg))
-	if err != nil {
-		return nil, err
-	} 
-	return nil, nil	
+	return common.RaiseError(stub, common.CodeValidation, "Received unknown function invocation")
 }
 
 // ============================================================================================================================
 // Query - Our entry point for Queries
 // ============================================================================================================================
-func (t *ManageAccount) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+func (t *ManageAccount) Query(stub shim.ChaincodeStubInterface, function string, args []string) (result []byte, err error) {
+	defer func() {
+		if err != nil {
+			err = common.AsError(err)
+		}
+	}()
 	fmt.Println("query is running " + function)
 
+	// only the roles in the query policy may call a function, and functions missing from it cannot be called
+	_, err = queryPolicy.Authorize(stub, function)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+
 	// Handle different functions
 	if function == "getAccountByOwner" {													//read a variable
 		return t.getAccountByOwner(stub, args)
+	}else if function == "getJournal" {										//read a single journal
+		return t.getJournal(stub, args)
+	}else if function == "getJournalsByAccount" {								//read the journal trail of an account
+		return t.getJournalsByAccount(stub, args)
+	}else if function == "reconcileAccount" {									//check the balance against the journals
+		return t.reconcileAccount(stub, args)
+	}else if function == "getFxRate" {											//read an FX rate
+		return t.getFxRate(stub, args)
+	}else if function == "getHold" {											//read the escrow hold of an agreement
+		return t.getHold(stub, args)
+	}else if function == "getHoldsByAccount" {									//read the escrow holds of an account
+		return t.getHoldsByAccount(stub, args)
+	}else if function == "getAccountHistory" {									//read every version of an account
+		return t.getAccountHistory(stub, args)
+	}else if function == "getAllowedCallers" {									//read the chaincodes allowed to move funds
+		return common.QueryAllowedCallers(stub)
 	}
 	fmt.Println("query did not find func: " + function)						//error
 
-	errMsg := "{ \"message\" : \"Received unknown function query\", \"code\" : \"503\"}"
-	err := stub.SetEvent("errEvent", []byte(errMsg))
-	if err != nil {
-		return nil, err
-	} 
-	return nil, nil
+	return common.RaiseError(stub, common.CodeValidation, "Received unknown function query")
+}
+
+// accountRequest is the JSON argument of createAccount. Amounts are decimal strings, each balance in the currency it is
+// listed under and the credit limit in the account currency, e.g. {"accountOwnerId": "C1", "accountName": "Customer",
+// "currency": "USD", "balances": {"USD": "100.00"}, "creditLimit": "500.00"}
+type accountRequest struct{
+	AccountOwnerId string `json:"accountOwnerId"`
+	AccountName string `json:"accountName"` // Customer or Service Provider
+	Currency string `json:"currency"` // home currency, DefaultCurrency when left out
+	Balances map[string]string `json:"balances"` // opening balance in each currency, only an admin may set them
+	CreditLimit string `json:"creditLimit"` // only an admin may grant one
 }
 
 // ============================================================================================================================
@@ -134,41 +220,89 @@ func (t *ManageAccount) Query(stub shim.ChaincodeStubInterface, function string,
 func (t *ManageAccount) createAccount(stub shim.ChaincodeStubInterface, args []string)([]byte, error){
 	
 	var err error
-	var account Account
+	var request accountRequest
 
-	if len(args) != 1 {
-		errMsg := "{ \"message\" : \"Incorrect number of arguments. Expecting \"account details\" as an argument.\", \"code\" : \"503\"}"
-		err = stub.SetEvent("errEvent", []byte(errMsg))
+	//input sanitation: the account details are an accountRequest in JSON
+	err = common.DecodePayload(args, "account details", &request)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	account := common.Account{AccountOwnerId: request.AccountOwnerId, AccountName: request.AccountName, Currency: request.Currency}
+	if account.AccountOwnerId == "" {
+		return common.Raise(stub, common.MissingField("accountOwnerId"))
+	}
+	if account.AccountName != common.AccountCustomer && account.AccountName != common.AccountServiceProvider {
+		return common.RaiseError(stub, common.CodeValidation, "accountName must be " + common.AccountCustomer + " or " + common.AccountServiceProvider + ".")
+	}
+	if account.Currency == "" {
+		account.Currency = common.DefaultCurrency
+	}
+	if _, err := common.Digits(account.Currency); err != nil {
+		return common.Raise(stub, common.FieldError("currency", err))
+	}
+	// balances are read in currency order, so that every peer rejects a bad account with the same error
+	account.Balances = make(map[string]common.Money)
+	currencies := []string{}
+	for currency := range request.Balances {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	for _, currency := range currencies {
+		balance, err := common.ParseAmountField("balances." + currency, request.Balances[currency], currency)
 		if err != nil {
-			return nil, err
-		} 
-		return nil, errors.New(errMsg)
+			return common.Raise(stub, err)
+		}
+		if currency != account.Currency && balance.IsNegative() {
+			return common.RaiseError(stub, common.CodeValidation, "Only the home currency balance may be negative.")
+		}
+		account.Balances[currency] = balance
 	}
-	
-	//input sanitation
-	if len(args[0]) <= 0 {
-		return nil, errors.New("Account details are required")
+	account.CreditLimit = common.Money{Currency: account.Currency}
+	if request.CreditLimit != "" {
+		account.CreditLimit, err = common.ParseAmountField("creditLimit", request.CreditLimit, account.Currency)
+		if err != nil {
+			return common.Raise(stub, err)
+		}
+	}
+	if account.CreditLimit.IsNegative() {
+		return common.RaiseError(stub, common.CodeValidation, "Credit limit cannot be negative.")
+	}
+	// Customers and Service Providers may only open their own account, of their own kind, without funds or credit
+	caller, err := common.GetIdentity(stub)
+	if err != nil {
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	if !caller.HasRole(common.RoleAdmin) {
+		if account.AccountOwnerId != caller.OwnerId || account.AccountName != accountNameByRole[caller.Role] {
+			return common.RejectUnauthorized(stub, caller.OwnerId + " can only open its own " + accountNameByRole[caller.Role] + " account.")
+		}
+		for _, currency := range account.Currencies() {
+			if !account.Balances[currency].IsZero() {
+				return common.RejectUnauthorized(stub, "Only an admin can open an account with a balance.")
+			}
+		}
+		if account.CreditLimit.Amount != 0 {
+			return common.RejectUnauthorized(stub, "Only an admin can grant a credit limit.")
+		}
 	}
-	accountData := args[0]
-	// Converting account details from bytes to Account struct
-	json.Unmarshal([]byte(accountData), &account)
 	// Fetching account details by account Owner ID
-	accountAsBytes, err := stub.GetState(account.AccountOwnerId)
+	accountAsBytes, err := getAccountState(stub, account.AccountOwnerId)
+	if err != nil {
+		return common.RaiseError(stub, common.CodeInternal, "Failed to get Account by Owner ID")
+	}
+	res := common.Account{}
+	err = common.DecodeState(accountAsBytes, "Account " + account.AccountOwnerId, &res)
 	if err != nil {
-		return nil, errors.New("Failed to get Account by Owner ID")
+		return common.Raise(stub, err)
 	}
-	res := Account{}
-	json.Unmarshal(accountAsBytes, &res)
 	fmt.Print("Account Details: ")
 	fmt.Println(res)
 	if res.AccountOwnerId == account.AccountOwnerId{
 		fmt.Println("This Account already exists: " + account.AccountOwnerId)
-		errMsg := "{ \"message\" : \"This Account already exists.\", \"code\" : \"503\"}"
-		err := stub.SetEvent("errEvent", []byte(errMsg))
-		if err != nil {
-			return nil, err
-		} 
-		return nil, errors.New(errMsg)				//stop creating a new account if account exists already
+		return common.RaiseError(stub, common.CodeConflict, "This Account already exists.")				//stop creating a new account if account exists already
+	}
+	if account.Balance(account.Currency).Amount < -account.CreditLimit.Amount {
+		return common.RaiseError(stub, common.CodeValidation, "Opening balance exceeds the credit limit of the account.")
 	}
 
 	//build the Account json string manually
@@ -176,34 +310,34 @@ func (t *ManageAccount) createAccount(stub shim.ChaincodeStubInterface, args []s
 	// if err != nil {
 	// 	return shim.Error(err.Error())
 	// }
-	//store AccountOwnerId as key
-	err = stub.PutState(account.AccountOwnerId, accountJSONasBytes)	
+	//store under the account~owner composite key, which is also how accounts are listed
+	err = putAccountState(stub, account.AccountOwnerId, accountJSONasBytes)
 	if err != nil {
 		return nil, err
 	}
-
-	//get the Account index
-	accountIndexStrAsBytes, err := stub.GetState(AccountIndexStr)
-	if err != nil {
-		return nil, errors.New("Failed to get Account index")
-	}
-	var accountIndex []string
-
-	json.Unmarshal(accountIndexStrAsBytes, &accountIndex)							//un stringify it aka JSON.parse()
-	fmt.Print("accountIndexStrAsBytes after unmarshal..before append: ")
-	fmt.Println(accountIndexStrAsBytes)
-
-	//append
-	accountIndex = append(accountIndex, account.AccountOwnerId)									//add AccountOwnerId to index list
-	fmt.Println("! Account index: ", accountIndex)
-	jsonAsBytes, _ := json.Marshal(accountIndex)
-	err = stub.PutState(AccountIndexStr, jsonAsBytes)						//store AccountOwnerId as an index
-	if err != nil {
-		return nil, err
+	// record the opening balances so that the account balances can be reconciled against its journals
+	for _, currency := range account.Currencies() {
+		balance := account.Balances[currency]
+		if balance.IsZero() {
+			continue
+		}
+		journal, err := newJournal(stub, common.OperationOpening, transferEntries(OpeningBalanceAccount, account.AccountOwnerId, balance)...)
+		if err != nil {
+			return nil, err
+		}
+		err = postJournal(stub, journal)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	tosend := "{ \"Account Owner ID\" : \""+account.AccountOwnerId+"\", \"message\" : \"Account created succcessfully\", \"code\" : \"200\"}"
-	err = stub.SetEvent("evtsender", []byte(tosend))
+	err = common.EmitEvent(stub, common.EventAccountCreated, account.AccountOwnerId, &common.AccountCreated{
+		AccountOwnerId: account.AccountOwnerId,
+		AccountName: account.AccountName,
+		Currency: account.Currency,
+		Balances: account.Balances,
+		CreditLimit: account.CreditLimit,
+	})
 	if err != nil {
 		return nil, err
 	} 
@@ -219,109 +353,303 @@ func (t *ManageAccount) getAccountByOwner(stub shim.ChaincodeStubInterface, args
 	var err error
 	fmt.Println("Fetching account by owner Id")
 	if len(args) != 1 {
-		errMsg := "{ \"message\" : \"Incorrect number of arguments. Expecting \"Account Owner Id\" as an argument.\", \"code\" : \"503\"}"
-		err = stub.SetEvent("errEvent", []byte(errMsg))
-		if err != nil {
-			return nil, err
-		} 
-		return nil, errors.New(errMsg)
+		return common.RaiseError(stub, common.CodeValidation, "Incorrect number of arguments. Expecting \"Account Owner Id\" as an argument.")
 	}
 	// set accountOwnerId
 	accountOwnerId := args[0]
-	valAsbytes, err := stub.GetState(accountOwnerId)									//get the accountOwnerId from chaincode state
+	err = authorizeOwner(stub, false, accountOwnerId)
 	if err != nil {
-		errMsg := "{ \"message\" : \""+ accountOwnerId + " not Found.\", \"code\" : \"503\"}"
-		err = stub.SetEvent("errEvent", []byte(errMsg))
-		if err != nil {
-			return nil, err
-		} 
-		fmt.Println(errMsg)	
-		return nil, errors.New(errMsg)
+		return common.RejectUnauthorized(stub, err.Error())
+	}
+	valAsbytes, err := getAccountState(stub, accountOwnerId)									//get the accountOwnerId from chaincode state
+	if err != nil {
+		return common.RaiseError(stub, common.CodeInternal, "Failed to get state for " + accountOwnerId)
+	}
+	// an account that was never created has no state, which is not an account
+	if len(valAsbytes) == 0 {
+		return common.RaiseError(stub, common.CodeNotFound, accountOwnerId + " not Found.")
 	}
 	fmt.Println("Account details fetched successfully.")
 	return valAsbytes, nil													//send it onward
 }
 
 // ============================================================================================================================
-// updateAccountBalance - update Account Balance into chaincode state
+// updateAccountBalance - post a balanced journal for the transfer and update the Account Balances into chaincode state
 // ============================================================================================================================
 func (t *ManageAccount) updateAccountBalance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var jsonResp string
-	var err error
+	// input sanitation, the arguments are those of common.UpdateBalanceRequest
+	request, err := common.ParseUpdateBalanceRequest(args)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	fmt.Println("Updating the account balance of"+ request.CustomerId + " and " + request.ServiceProviderId)
+	if request.CustomerId == request.ServiceProviderId {
+		return common.RaiseError(stub, common.CodeValidation, "Customer and Service Provider accounts must be different.")
+	}
+	_amountPaid := request.Amount
+	if !_amountPaid.IsPositive() {
+		return common.RaiseError(stub, common.CodeValidation, "Amount paid must be positive.")
+	}
+	operation := request.Operation
+	payer, payee, err := request.PayerAndPayee()
+	if err != nil {
+		return common.Raise(stub, err)
+	}
 
-	//set amountPaid
-	amountPaid := args[2]
+	// the caller must be one of the parties of the transfer, or an arbiter settling their dispute
+	err = authorizeOwner(stub, true, request.CustomerId, request.ServiceProviderId)
+	if err != nil {
+		return common.RejectSecurity(stub, common.FunctionUpdateAccountBalance, err)
+	}
+	// phase 1: load and validate both accounts before anything is written
+	accounts, err := loadParties(stub, request.CustomerId, request.ServiceProviderId)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	// the payer always pays from its home currency, converting at the on-ledger FX rate when the agreement currency differs
+	settlement, entries, err := paymentEntries(stub, accounts[payer], payer, payee, _amountPaid)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	journal, err := newJournal(stub, operation, entries...)
+	if err != nil {
+		return nil, err
+	}
+	settlement.JournalId = journal.JournalId
+	err = applyJournal(accounts, journal)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+
+	// phase 2: commit both accounts and the journal
+	err = saveAccounts(stub, accounts[request.CustomerId], accounts[request.ServiceProviderId])
+	if err != nil {
+		return nil, err
+	}
+	// record the line items of this balance change
+	err = postJournal(stub, journal)
+	if err != nil {
+		return nil, err
+	}
+	// event message to set on successful account updation
+	settlement.Operation = operation
+	settlement.PayerId = payer
+	settlement.PayeeId = payee
+	err = common.EmitEvent(stub, common.EventBalanceUpdated, payer, settlement.BalanceUpdated())
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Account balance Updated Successfully.")
+	return json.Marshal(settlement)
+}
 
-	// input sanitation
-	if len(args) != 4 {
-		errMsg := "{ \"message\" : \"Incorrect number of arguments. Expecting \"Customer Account Id, Service Provider Account Id, Amount paid\" and \" operation\" as an argument.\", \"code\" : \"503\"}"
-		err = stub.SetEvent("errEvent", []byte(errMsg))
+// ============================================================================================================================
+// loadParties - load the Customer and Service Provider accounts of a transfer, checking that both exist with the right role
+// ============================================================================================================================
+func loadParties(stub shim.ChaincodeStubInterface, customerId string, serviceProviderId string) (map[string]*common.Account, error) {
+	if customerId == serviceProviderId {
+		return nil, common.NewError(common.CodeValidation, "Customer and Service Provider accounts must be different.")
+	}
+	accounts := make(map[string]*common.Account)
+	for _, accountOwnerId := range []string{customerId, serviceProviderId} {
+		accountAsBytes, err := getAccountState(stub, accountOwnerId)									//get the var from chaincode state
+		if err != nil {
+			return nil, errors.New("Failed to get state for " + accountOwnerId)
+		}
+		account := common.Account{}
+		err = common.DecodeState(accountAsBytes, "Account " + accountOwnerId, &account)
 		if err != nil {
 			return nil, err
 		}
-		fmt.Println(errMsg)	
-		return nil, errors.New(errMsg)
+		if len(accountAsBytes) == 0 || account.AccountOwnerId != accountOwnerId {
+			return nil, common.NewError(common.CodeNotFound, accountOwnerId + " Not Found.")
+		}
+		fmt.Println(account.AccountName + " Account found with account Owner Id : " + accountOwnerId)
+		accounts[accountOwnerId] = &account
 	}
+	if accounts[customerId].AccountName != common.AccountCustomer {
+		return nil, common.NewError(common.CodeValidation, customerId + " is not a Customer account.")
+	}
+	if accounts[serviceProviderId].AccountName != common.AccountServiceProvider {
+		return nil, common.NewError(common.CodeValidation, serviceProviderId + " is not a Service Provider account.")
+	}
+	return accounts, nil
+}
 
-	fmt.Println("Updating the account balance of"+ args[0] + " and " + args[1])
-	// convert string to float
-	_amountPaid, _ := strconv.ParseFloat(amountPaid, 64)
-	operation := args[3]
-	account := Account{}
-	for i := 0; i < 2; i++ {
-		accountAsBytes, err := stub.GetState(args[i])									//get the var from chaincode state
+// ============================================================================================================================
+// paymentEntries - the journal entries for payer paying amount to payee from the payer's home currency. When the amount is
+// in another currency it is converted at the on-ledger FX rate and passes through the FX clearing account.
+// ============================================================================================================================
+func paymentEntries(stub shim.ChaincodeStubInterface, payerAccount *common.Account, payer string, payee string, amount common.Money) (common.Settlement, []JournalEntry, error) {
+	settlement, err := payerSettlement(stub, payerAccount, amount)
+	if err != nil {
+		return settlement, nil, err
+	}
+	return settlement, conversionEntries(payer, payee, settlement), nil
+}
+
+// ============================================================================================================================
+// payerSettlement - what the payer pays from its home currency for amount, at the on-ledger FX rate when they differ
+// ============================================================================================================================
+func payerSettlement(stub shim.ChaincodeStubInterface, payerAccount *common.Account, amount common.Money) (common.Settlement, error) {
+	settlement := common.Settlement{Amount: amount, PayerAmount: amount}
+	if payerAccount.Currency == amount.Currency {
+		return settlement, nil
+	}
+	rate, err := lookupFxRate(stub, amount.Currency, payerAccount.Currency)
+	if err != nil {
+		return settlement, err
+	}
+	settlement.PayerAmount, err = amount.Convert(rate, payerAccount.Currency)
+	if err != nil {
+		return settlement, err
+	}
+	settlement.FxRate = rate.String()
+	return settlement, nil
+}
+
+// ============================================================================================================================
+// conversionEntries - the entries moving settlement.PayerAmount out of payer and settlement.Amount into payee, through the
+// FX clearing account when the two are in different currencies
+// ============================================================================================================================
+func conversionEntries(payer string, payee string, settlement common.Settlement) []JournalEntry {
+	if settlement.PayerAmount.Currency == settlement.Amount.Currency {
+		return transferEntries(payer, payee, settlement.Amount)
+	}
+	return append(transferEntries(payer, FxClearingAccount, settlement.PayerAmount), transferEntries(FxClearingAccount, payee, settlement.Amount)...)
+}
+
+// ============================================================================================================================
+// applyJournal - apply the entries of a journal to the loaded accounts, enforcing overdraft protection on every debit
+// ============================================================================================================================
+func applyJournal(accounts map[string]*common.Account, journal Journal) error {
+	for _, entry := range journal.Entries {
+		account, ok := accounts[entry.AccountOwnerId]
+		if !ok {
+			continue	// system accounts such as the FX clearing account have no Account record
+		}
+		balance, err := applyEntry(account.Balance(entry.Credit.Currency), entry)
 		if err != nil {
-			jsonResp = "{\"Error\":\"Failed to get state for " + args[i] + "\"}"
-			return nil, errors.New(jsonResp)
+			return err
+		}
+		if account.Balances == nil {
+			account.Balances = make(map[string]common.Money)
 		}
-		json.Unmarshal(accountAsBytes, &account)
-		if account.AccountOwnerId == args[i]{
-			if account.AccountName == "Customer" {
-				fmt.Println("Customer Account found with account Owner Id : " + args[i])
-				fmt.Println(account);
-				if operation == "Initial" || operation == "Final" {
-					account.AccountBalance =  account.AccountBalance - _amountPaid
-				}else{
-					account.AccountBalance =  account.AccountBalance + _amountPaid
-				}
-			} else if account.AccountName == "Service Provider" {
-				fmt.Println("Service Provider Account found with account Owner Id : " + args[i])
-				fmt.Println(account);
-				if operation == "Final" || operation == "Initial"{
-					account.AccountBalance =  account.AccountBalance + _amountPaid
-				}else {
-					account.AccountBalance =  account.AccountBalance - _amountPaid
-				}
+		account.Balances[balance.Currency] = balance
+		// overdraft protection: a debit may not take the balance below the credit limit, which only applies to the home currency
+		if entry.Debit.IsPositive() {
+			limit := common.Money{Currency: balance.Currency}
+			if balance.Currency == account.Currency {
+				limit = account.CreditLimit
 			}
-		}else {
-			errMsg := "{ \"message\" : \""+ args[i]+ " Not Found.\", \"code\" : \"503\"}"
-			err = stub.SetEvent("errEvent", []byte(errMsg))
-			if err != nil {
-				return nil, err
+			if balance.Amount < -limit.Amount {
+				return common.NewError(common.CodeInsufficientFunds, "Insufficient funds in account " + account.AccountOwnerId + ". Paying " + entry.Debit.String() + " would exceed its credit limit of " + limit.String() + ".")
 			}
-			fmt.Println(errMsg); 
 		}
-		
-		//build the Payment json string
-		accountJson := &Account{account.AccountOwnerId,account.AccountName,account.AccountBalance}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// saveAccounts - store the accounts into chaincode state
+// ============================================================================================================================
+func saveAccounts(stub shim.ChaincodeStubInterface, accounts ...*common.Account) error {
+	for _, account := range accounts {
 		// convert *Account to []byte
-		accountJsonasBytes, err := json.Marshal(accountJson)
+		accountJsonasBytes, err := json.Marshal(account)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		//store account Owner Id as key
-		err = stub.PutState(account.AccountOwnerId, accountJsonasBytes)								
+		err = putAccountState(stub, account.AccountOwnerId, accountJsonasBytes)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		// event message to set on successful account updation
-		tosend := "{ \"Account Owner Id\" : \""+account.AccountOwnerId+"\", \"message\" : \"Account updated succcessfully\", \"code\" : \"200\"}"
-		err = stub.SetEvent("evtsender", []byte(tosend))
-		if err != nil {
-			return nil, err
-		}
-		fmt.Println(tosend); 	
 	}
-	fmt.Println("Account balance Updated Successfully.")
+	return nil
+}
+
+// ============================================================================================================================
+// getAccountState - fetch the stored Account of an owner, empty when there is none
+// ============================================================================================================================
+func getAccountState(stub shim.ChaincodeStubInterface, accountOwnerId string) ([]byte, error) {
+	key, err := common.CreateCompositeKey(AccountObjectType, accountOwnerId)
+	if err != nil {
+		return nil, err
+	}
+	return stub.GetState(key)
+}
+
+// ============================================================================================================================
+// putAccountState - store the Account of an owner under its account~owner composite key and keep it in its history
+// ============================================================================================================================
+func putAccountState(stub shim.ChaincodeStubInterface, accountOwnerId string, accountAsBytes []byte) error {
+	key, err := common.CreateCompositeKey(AccountObjectType, accountOwnerId)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(key, accountAsBytes)
+	if err != nil {
+		return err
+	}
+	return common.RecordHistory(stub, AccountObjectType, accountOwnerId, accountAsBytes)
+}
+
+// creditLimitRequest is the JSON argument of updateCreditLimit
+type creditLimitRequest struct{
+	AccountOwnerId string `json:"accountOwnerId"`
+	CreditLimit string `json:"creditLimit"` // decimal amount in the account currency, e.g. "5000.00"
+}
+
+// ============================================================================================================================
+// updateCreditLimit - admin function to change how far below zero an account balance may go
+// ============================================================================================================================
+func (t *ManageAccount) updateCreditLimit(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	request := creditLimitRequest{}
+	err := common.DecodePayload(args, "credit limit", &request)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	accountOwnerId := request.AccountOwnerId
+	err = common.RequireField("accountOwnerId", accountOwnerId)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	accountAsBytes, err := getAccountState(stub, accountOwnerId)
+	if err != nil {
+		return common.RaiseError(stub, common.CodeInternal, "Failed to get state for " + accountOwnerId)
+	}
+	account := common.Account{}
+	err = common.DecodeState(accountAsBytes, "Account " + accountOwnerId, &account)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	if len(accountAsBytes) == 0 || account.AccountOwnerId != accountOwnerId {
+		return common.RaiseError(stub, common.CodeNotFound, accountOwnerId + " Not Found.")
+	}
+	creditLimit, err := common.ParseAmountField("creditLimit", request.CreditLimit, account.Currency)
+	if err != nil {
+		return common.Raise(stub, err)
+	}
+	if creditLimit.IsNegative() {
+		return common.RaiseError(stub, common.CodeValidation, "Credit limit cannot be negative.")
+	}
+	if account.Balance(account.Currency).Amount < -creditLimit.Amount {
+		return common.RaiseError(stub, common.CodeValidation, "Account " + accountOwnerId + " is already overdrawn beyond the new credit limit.")
+	}
+	account.CreditLimit = creditLimit
+	accountJsonasBytes, err := json.Marshal(account)
+	if err != nil {
+		return nil, err
+	}
+	err = putAccountState(stub, account.AccountOwnerId, accountJsonasBytes)
+	if err != nil {
+		return nil, err
+	}
+	err = common.EmitEvent(stub, common.EventCreditLimitChanged, account.AccountOwnerId, &common.CreditLimitChanged{AccountOwnerId: account.AccountOwnerId, CreditLimit: creditLimit})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Credit limit updated successfully.")
 	return nil, nil
 }
+
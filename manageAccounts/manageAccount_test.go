@@ -0,0 +1,47 @@
+package main
+
+import (
+"testing"
+
+"github.com/Dimple-Kanwar/Office-Depot/common"
+)
+
+func money(amount int64, currency string) common.Money {
+	return common.Money{Amount: amount, Currency: currency}
+}
+
+func TestApplyJournal(t *testing.T) {
+	cases := []struct{
+		name string
+		entries []JournalEntry
+		customerUSD int64
+		customerEUR int64
+		code string // error code expected, empty when the journal applies
+	}{
+		{"transfer within the balance", transferEntries("C1", "S1", money(4000, "USD")), 6000, 2000, ""},
+		{"debit down to the credit limit", transferEntries("C1", "S1", money(15000, "USD")), -5000, 2000, ""},
+		{"debit beyond the credit limit", transferEntries("C1", "S1", money(15001, "USD")), 0, 0, common.CodeInsufficientFunds},
+		{"debit of a foreign currency has no credit limit", transferEntries("C1", "S1", money(2001, "EUR")), 0, 0, common.CodeInsufficientFunds},
+		{"system accounts have no record", transferEntries(FxClearingAccount, "C1", money(500, "EUR")), 10000, 2500, ""},
+	}
+	for _, c := range cases {
+		customer := &common.Account{AccountOwnerId: "C1", Currency: "USD", CreditLimit: money(5000, "USD"),
+			Balances: map[string]common.Money{"USD": money(10000, "USD"), "EUR": money(2000, "EUR")}}
+		provider := &common.Account{AccountOwnerId: "S1", Currency: "USD"}
+		accounts := map[string]*common.Account{"C1": customer, "S1": provider}
+		err := applyJournal(accounts, Journal{JournalId: "JN1", Entries: c.entries})
+		if c.code != "" {
+			if err == nil || common.AsError(err).Code != c.code {
+				t.Errorf("%s: error %v, want %s", c.name, err, c.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if customer.Balance("USD").Amount != c.customerUSD || customer.Balance("EUR").Amount != c.customerEUR {
+			t.Errorf("%s: customer balances %v, want %d USD and %d EUR cents", c.name, customer.Balances, c.customerUSD, c.customerEUR)
+		}
+	}
+}